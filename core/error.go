@@ -16,7 +16,12 @@
 
 package core
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/eximchain/go-ethereum/common"
+)
 
 var (
 	// ErrKnownBlock is returned when a block to import is already known locally.
@@ -24,12 +29,162 @@ var (
 
 	// ErrGasLimitReached is returned by the gas pool if the amount of gas required
 	// by a transaction is higher than what's left in the block.
-	ErrGasLimitReached = errors.New("gas limit reached")
+	ErrGasLimitReached = newCoreError(KindGasLimitReached, "gas limit reached")
 
 	// ErrBlacklistedHash is returned if a block to import is on the blacklist.
 	ErrBlacklistedHash = errors.New("blacklisted hash")
 
 	// ErrNonceTooHigh is returned if the nonce of a transaction is higher than the
 	// next one expected based on the local chain.
-	ErrNonceTooHigh = errors.New("nonce too high")
+	ErrNonceTooHigh = newCoreError(KindNonceTooHigh, "nonce too high")
+
+	// ErrInsufficientBalanceForGas is returned if the gas payer of a message can't
+	// pay for the gas it allows. State transitions wrap it in a GasPayerError.
+	ErrInsufficientBalanceForGas = newCoreError(KindInsufficientFunds, "insufficient balance to pay for gas")
+
+	// ErrStateGrowthLimitExceeded is returned if executing a message would add
+	// more new state than the configured per-transition limit allows.
+	ErrStateGrowthLimitExceeded = errors.New("state growth limit exceeded")
+
+	// ErrStateRootMismatch is returned if the intermediate state root after a
+	// transition differs from the root the caller expected.
+	ErrStateRootMismatch = errors.New("state root mismatch")
+
+	// ErrExecutionCancelled is returned if the context of a state transition is
+	// cancelled or times out before the message finished executing.
+	ErrExecutionCancelled = errors.New("execution cancelled")
+
+	// ErrSenderNoEOA is returned if the sender of a transaction is a contract,
+	// i.e. has code, once EIP-3607 is active.
+	ErrSenderNoEOA = errors.New("sender not an eoa")
+
+	// ErrGasAllowanceExceeded is returned by gas estimation if a message runs out
+	// of gas even with the highest gas allowance.
+	ErrGasAllowanceExceeded = errors.New("gas required exceeds allowance")
+
+	// ErrCalldataTooLarge is returned if the data of a message is larger than the
+	// maximum a state transition accepts.
+	ErrCalldataTooLarge = errors.New("calldata too large")
+)
+
+// ErrorKind classifies the errors rejecting transactions and messages.
+type ErrorKind uint8
+
+const (
+	KindUnknown            ErrorKind = iota // Error not classified
+	KindNonceTooLow                         // Nonce lower than the sender's
+	KindNonceTooHigh                        // Nonce higher than the sender's
+	KindInsufficientFunds                   // Sender can't pay for gas or value
+	KindIntrinsicGasTooLow                  // Gas allowance below the intrinsic gas
+	KindGasLimitReached                     // Gas allowance above what's left in the block
 )
+
+// String implements fmt.Stringer.
+func (kind ErrorKind) String() string {
+	switch kind {
+	case KindNonceTooLow:
+		return "nonce too low"
+	case KindNonceTooHigh:
+		return "nonce too high"
+	case KindInsufficientFunds:
+		return "insufficient funds"
+	case KindIntrinsicGasTooLow:
+		return "intrinsic gas too low"
+	case KindGasLimitReached:
+		return "gas limit reached"
+	default:
+		return "unknown"
+	}
+}
+
+// CoreError is implemented by the errors rejecting transactions and messages
+// that can be classified, allowing callers to tell them apart without string
+// matching.
+type CoreError interface {
+	error
+	Kind() ErrorKind
+}
+
+// ErrorKindOf returns the kind of the given error, or KindUnknown if it is not
+// a CoreError.
+func ErrorKindOf(err error) ErrorKind {
+	if err, ok := err.(CoreError); ok {
+		return err.Kind()
+	}
+	return KindUnknown
+}
+
+// coreError is a classified error with a fixed message.
+type coreError struct {
+	kind ErrorKind
+	text string
+}
+
+// newCoreError returns a classified error with the given message.
+func newCoreError(kind ErrorKind, text string) error {
+	return &coreError{kind: kind, text: text}
+}
+
+func (err *coreError) Error() string   { return err.text }
+func (err *coreError) Kind() ErrorKind { return err.kind }
+
+// NonceError is returned if the nonce of a message doesn't match the next nonce
+// of its sender.
+type NonceError struct {
+	Want uint64 // Next nonce of the sender
+	Got  uint64 // Nonce of the message
+}
+
+func (err *NonceError) Error() string {
+	return fmt.Sprintf("%v: got %d, want %d", err.Unwrap(), err.Got, err.Want)
+}
+
+// Unwrap returns ErrNonceTooLow or ErrNonceTooHigh, the sentinel error the nonce
+// error corresponds to.
+func (err *NonceError) Unwrap() error {
+	if err.Got < err.Want {
+		return ErrNonceTooLow
+	}
+	return ErrNonceTooHigh
+}
+
+// Kind implements CoreError, classifying the error as a too low or too high nonce.
+func (err *NonceError) Kind() ErrorKind {
+	if err.Got < err.Want {
+		return KindNonceTooLow
+	}
+	return KindNonceTooHigh
+}
+
+// GasPayerError is returned if the account paying for the gas of a message, i.e.
+// its sender or sponsor, can't afford the gas the message allows.
+type GasPayerError struct {
+	Payer common.Address // Account the gas was to be bought from
+}
+
+func (err *GasPayerError) Error() string {
+	return fmt.Sprintf("%v: payer %s", ErrInsufficientBalanceForGas, err.Payer.Hex())
+}
+
+// Unwrap returns ErrInsufficientBalanceForGas.
+func (err *GasPayerError) Unwrap() error { return ErrInsufficientBalanceForGas }
+
+// Kind implements CoreError, classifying the error as insufficient funds.
+func (err *GasPayerError) Kind() ErrorKind { return KindInsufficientFunds }
+
+// BatchError is returned if a message of a batch applied with ApplyMessages is
+// rejected, identifying the message.
+type BatchError struct {
+	Index int   // Position of the rejected message in the batch
+	Err   error // Error the message was rejected with
+}
+
+func (err *BatchError) Error() string {
+	return fmt.Sprintf("message %d: %v", err.Index, err.Err)
+}
+
+// Unwrap returns the error the message was rejected with.
+func (err *BatchError) Unwrap() error { return err.Err }
+
+// Kind implements CoreError, classifying the error as the rejection error.
+func (err *BatchError) Kind() ErrorKind { return ErrorKindOf(err.Err) }
@@ -0,0 +1,111 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/core/vm"
+)
+
+// gasMessage is a message with its gas allowance replaced.
+type gasMessage struct {
+	Message
+	gas uint64
+}
+
+func (msg gasMessage) Gas() uint64 { return msg.gas }
+
+// GasPayer retains the gas payer of sponsored messages.
+func (msg gasMessage) GasPayer() *common.Address {
+	if sponsored, ok := msg.Message.(SponsoredMessage); ok {
+		return sponsored.GasPayer()
+	}
+	return nil
+}
+
+// EstimateGas binary searches the smallest gas allowance the message executes
+// successfully with on top of the EVM's state. The search is capped by the gas
+// allowance of the message or, if it doesn't cover the base transaction cost,
+// by the gas available in the pool. For priced messages it is further capped by
+// the gas the gas payer can afford. Every attempt is reverted, leaving both the
+// state and the gas pool untouched, and is not recorded in the metrics.
+//
+// If the message fails even with the highest allowance, the error of the EVM
+// is returned if it didn't run out of gas (e.g. a revert), otherwise
+// ErrGasAllowanceExceeded. Consensus errors are returned as is.
+func EstimateGas(evm *vm.EVM, msg Message, gp *GasPool) (uint64, error) {
+	schedule := evm.ChainConfig().IntrinsicGasSchedule(evm.BlockNumber)
+	var (
+		lo = schedule.TxGas - 1
+		hi = msg.Gas()
+	)
+	if hi < schedule.TxGas {
+		hi = gp.Gas()
+	}
+	// Cap the allowance by what the gas payer can afford besides the value
+	if price := msg.GasPrice(); price.Sign() > 0 {
+		payer := msg.From()
+		if sponsored, ok := msg.(SponsoredMessage); ok && sponsored.GasPayer() != nil {
+			payer = *sponsored.GasPayer()
+		}
+		available := new(big.Int).Set(evm.StateDB.GetBalance(payer))
+		if payer == msg.From() && msg.Value() != nil {
+			available.Sub(available, msg.Value())
+		}
+		if available.Sign() >= 0 {
+			if allowance := available.Div(available, price); allowance.IsUint64() && allowance.Uint64() < hi {
+				hi = allowance.Uint64()
+			}
+		}
+	}
+	// No allowance below the intrinsic gas can succeed, start the search there
+	if gas, err := intrinsicGas(msg.Data(), msg.AccessList(), msg.To() == nil, schedule); err == nil && gas > lo+1 && gas <= hi {
+		lo = gas - 1
+	}
+	// Create a helper executing the message with the given gas allowance
+	execute := func(gas uint64) (*ExecutionResult, error) {
+		snapshot := evm.StateDB.Snapshot()
+		defer evm.StateDB.RevertToSnapshot(snapshot)
+
+		st := NewStateTransition(evm, gasMessage{msg, gas}, new(GasPool).AddGas(gp.Gas()))
+		st.unmetered = true
+		return st.TransitionDb2()
+	}
+	// Make sure the message can execute at all before searching
+	result, err := execute(hi)
+	if err != nil {
+		return 0, err
+	}
+	if result.Failed() {
+		if result.Err == vm.ErrOutOfGas {
+			return 0, ErrGasAllowanceExceeded
+		}
+		return 0, result.Err
+	}
+	// Execute the binary search and hone in on an executable gas limit
+	for lo+1 < hi {
+		mid := (hi + lo) / 2
+		if result, err := execute(mid); err != nil || result.Failed() {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/core/types"
+	"github.com/eximchain/go-ethereum/core/vm"
+	"github.com/eximchain/go-ethereum/metrics"
+	"github.com/eximchain/go-ethereum/params"
+)
+
+// Tests that gas estimation finds the exact gas requirement of a message,
+// leaving the state untouched, and tells reverts apart from running out of gas.
+func TestEstimateGas(t *testing.T) {
+	tests := []struct {
+		code    []byte
+		gas     uint64
+		want    uint64
+		err     error
+		reverts bool
+	}{
+		// Plain transfer
+		{nil, 0, params.TxGas, nil, false},
+		// Storing a non-zero value into an empty slot
+		{[]byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE)}, 0, params.TxGas + 6 + params.SstoreSetGas, nil, false},
+		{[]byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE)}, 30000, 0, ErrGasAllowanceExceeded, false},
+		// Unconditional revert
+		{[]byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)}, 0, 0, nil, true},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, tt.code)
+		root := statedb.IntermediateRoot(false)
+
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), tt.gas, big.NewInt(1), nil, true)
+		gp := new(GasPool).AddGas(params.GenesisGasLimit)
+
+		gas, err := EstimateGas(evm, msg, gp)
+		switch {
+		case tt.reverts:
+			// Reverts must surface the EVM error instead of an allowance error
+			if err == nil || err == ErrGasAllowanceExceeded {
+				t.Errorf("test %d: revert error mismatch: have %v", i, err)
+			}
+		case err != tt.err:
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		case gas != tt.want:
+			t.Errorf("test %d: estimate mismatch: have %d, want %d", i, gas, tt.want)
+		}
+		if statedb.IntermediateRoot(false) != root {
+			t.Errorf("test %d: estimation modified the state", i)
+		}
+		if gp.Gas() != params.GenesisGasLimit {
+			t.Errorf("test %d: estimation modified the gas pool: have %d, want %d", i, gp.Gas(), params.GenesisGasLimit)
+		}
+	}
+}
+
+// Tests that the search is capped by the gas the gas payer can afford, with
+// sponsored messages charged to their gas payer.
+func TestEstimateGasBalanceCap(t *testing.T) {
+	var (
+		poor    = common.HexToAddress("0x7000000000000000000000000000000000000007")
+		sponsor = common.HexToAddress("0x8000000000000000000000000000000000000008")
+		// Storing a non-zero value into an empty slot
+		code = []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE)}
+		need = params.TxGas + 6 + params.SstoreSetGas
+	)
+	tests := []struct {
+		balance int64
+		value   int64
+		payer   *common.Address
+		want    uint64
+		err     error
+	}{
+		{int64(need), 0, nil, need, nil},
+		{int64(need) - 1, 0, nil, 0, ErrGasAllowanceExceeded},
+		{int64(need) + 10, 10, nil, need, nil},
+		{int64(need) + 10, 11, nil, 0, ErrGasAllowanceExceeded},
+		{0, 0, &sponsor, need, nil},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, code)
+		statedb.AddBalance(poor, big.NewInt(tt.balance))
+		statedb.AddBalance(sponsor, big.NewInt(int64(need)))
+
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := sponsoredMessage{
+			Message: types.NewMessage(poor, &transitionContract, 0, big.NewInt(tt.value), 0, big.NewInt(1), nil, true),
+			payer:   tt.payer,
+		}
+		gas, err := EstimateGas(evm, msg, new(GasPool).AddGas(params.GenesisGasLimit))
+		if err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		} else if gas != tt.want {
+			t.Errorf("test %d: estimate mismatch: have %d, want %d", i, gas, tt.want)
+		}
+	}
+}
+
+// Tests that the executions probing the gas allowance are not metered.
+func TestEstimateGasUnmetered(t *testing.T) {
+	enabled := metrics.Enabled
+	counter, histogram, timer := transitionPublicCounter, transitionGasHistogram, transitionExecutionTimer
+	defer func() {
+		metrics.Enabled = enabled
+		transitionPublicCounter, transitionGasHistogram, transitionExecutionTimer = counter, histogram, timer
+	}()
+	metrics.Enabled = true
+	transitionPublicCounter = metrics.NewCounter()
+	transitionGasHistogram = metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	transitionExecutionTimer = metrics.NewTimer()
+
+	statedb := newTransitionTestState()
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 0, big.NewInt(1), nil, true)
+	if _, err := EstimateGas(evm, msg, new(GasPool).AddGas(params.GenesisGasLimit)); err != nil {
+		t.Fatalf("estimation failed: %v", err)
+	}
+	if count := transitionPublicCounter.Count(); count != 0 {
+		t.Errorf("transition counter mismatch: have %d, want 0", count)
+	}
+	if count := transitionGasHistogram.Count(); count != 0 {
+		t.Errorf("gas histogram count mismatch: have %d, want 0", count)
+	}
+	if count := transitionExecutionTimer.Count(); count != 0 {
+		t.Errorf("execution timer count mismatch: have %d, want 0", count)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build gofuzz
+
+package core
+
+import (
+	"math/big"
+
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/core/types"
+	"github.com/eximchain/go-ethereum/params"
+)
+
+// Fuzz implements a go-fuzz fuzzer method to test the intrinsic gas calculation
+// against an arbitrary precision reference implementation. The first byte of
+// the input selects the fork rules, message kind and whether the chain overrides
+// the data prices, the second the size of the access list and the magnitude of
+// the overrides, and the remainder is the message data. The prices are resolved
+// through the chain config like state transitions do.
+func Fuzz(input []byte) int {
+	if len(input) < 2 {
+		return -1
+	}
+	config := new(params.ChainConfig)
+	if input[0]&2 != 0 {
+		config.HomesteadBlock = new(big.Int)
+	}
+	if input[0]&4 != 0 {
+		config.IstanbulBlock = new(big.Int)
+	}
+	if input[0]&8 != 0 {
+		// Large custom prices make overflows reachable with little data
+		price := uint64(input[1]) << (input[1] % 64)
+		config.IntrinsicGas = &params.IntrinsicGasSchedule{TxDataZeroGas: price, TxDataNonZeroGas: price + 1}
+	}
+	var (
+		creation = input[0]&1 != 0
+		schedule = config.IntrinsicGasSchedule(new(big.Int))
+		list     = make(types.AccessList, input[1]%8)
+		data     = input[2:]
+	)
+	for i := range list {
+		list[i].StorageKeys = make([]common.Hash, i)
+	}
+	gas, err := intrinsicGas(data, list, creation, schedule)
+	if want := referenceIntrinsicGas(data, list, creation, schedule); !want.IsUint64() {
+		if err == nil {
+			panic("overflow not detected")
+		}
+	} else if err != nil || gas != want.Uint64() {
+		panic("intrinsic gas mismatch")
+	}
+	return 1
+}
+
+// referenceIntrinsicGas computes the intrinsic gas without overflow checks.
+func referenceIntrinsicGas(data []byte, list types.AccessList, creation bool, schedule params.IntrinsicGasSchedule) *big.Int {
+	gas := new(big.Int).SetUint64(schedule.TxGas)
+	if creation {
+		gas.SetUint64(schedule.TxGasContractCreation)
+	}
+	for _, b := range data {
+		if b != 0 {
+			gas.Add(gas, new(big.Int).SetUint64(schedule.TxDataNonZeroGas))
+		} else {
+			gas.Add(gas, new(big.Int).SetUint64(schedule.TxDataZeroGas))
+		}
+	}
+	for _, tuple := range list {
+		gas.Add(gas, new(big.Int).SetUint64(params.TxAccessListAddressGas))
+		gas.Add(gas, new(big.Int).SetUint64(uint64(len(tuple.StorageKeys))*params.TxAccessListStorageKeyGas))
+	}
+	return gas
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/eximchain/go-ethereum/core/vm"
+)
+
+// stateFinaliser is implemented by state databases able to finalise the changes
+// of a transaction, e.g. to delete the empty accounts it touched.
+type stateFinaliser interface {
+	Finalise(deleteEmptyObjects bool)
+}
+
+// ApplyMessages applies the messages in order on top of the EVM's state, each
+// one seeing the changes of the previous ones, and returns their results. The
+// origin and gas price of the EVM are switched to those of each message, and
+// the state is finalised between messages like during block processing.
+//
+// If a message is rejected, the results of the messages applied before it are
+// returned along with a *BatchError holding its index and rejection error. The
+// state then includes the changes of the applied messages only.
+func ApplyMessages(evm *vm.EVM, msgs []Message, gp *GasPool) ([]*ExecutionResult, error) {
+	results := make([]*ExecutionResult, 0, len(msgs))
+	for i, msg := range msgs {
+		evm.Origin = msg.From()
+		evm.GasPrice = msg.GasPrice()
+
+		result, err := ApplyMessageResult(evm, msg, gp)
+		if err != nil {
+			return results, &BatchError{Index: i, Err: err}
+		}
+		if statedb, ok := evm.StateDB.(stateFinaliser); ok {
+			statedb.Finalise(evm.ChainConfig().IsEIP158(evm.BlockNumber))
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// ValidateGasAccounting applies the messages in order on top of the EVM's state
+// and verifies that the gas used by the individual messages sums up to the
+// expected total, e.g. the gas used field of a block header. It additionally
+// checks that the gas drawn from the gas pool matches the reported gas usage.
+// The messages are applied like by ApplyMessages, so a message failing with a
+// consensus error aborts the validation with a *BatchError.
+func ValidateGasAccounting(evm *vm.EVM, msgs []Message, gp *GasPool, expected uint64) error {
+	available := gp.Gas()
+
+	results, err := ApplyMessages(evm, msgs, gp)
+	if err != nil {
+		return err
+	}
+	var used uint64
+	for _, result := range results {
+		used += result.UsedGas
+	}
+	if consumed := available - gp.Gas(); consumed != used {
+		return fmt.Errorf("gas pool mismatch (consumed: %d reported: %d)", consumed, used)
+	}
+	if used != expected {
+		return fmt.Errorf("invalid gas used (expected: %d computed: %d)", expected, used)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/core/types"
+	"github.com/eximchain/go-ethereum/core/vm"
+	"github.com/eximchain/go-ethereum/params"
+)
+
+// Tests that batches of messages are applied in order on the evolving state and
+// that the first rejected message stops the batch, reporting its index.
+func TestApplyMessages(t *testing.T) {
+	var (
+		other = common.HexToAddress("0x4000000000000000000000000000000000000004")
+		value = big.NewInt(1000)
+
+		// Return the origin of the transaction
+		code = []byte{
+			byte(vm.ORIGIN), byte(vm.PUSH1), 0, byte(vm.MSTORE),
+			byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.RETURN),
+		}
+	)
+	statedb := newTransitionTestState()
+	statedb.AddBalance(other, big.NewInt(params.Ether))
+	statedb.SetCode(transitionContract, code)
+
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+	msgs := []Message{
+		types.NewMessage(transitionSender, &transitionContract, 0, value, 50000, big.NewInt(1), nil, true),
+		types.NewMessage(other, &transitionContract, 0, value, 50000, big.NewInt(1), nil, true),
+		types.NewMessage(transitionSender, &transitionContract, 0, value, 50000, big.NewInt(1), nil, true),
+		types.NewMessage(transitionSender, &transitionContract, 1, value, 50000, big.NewInt(1), nil, true),
+	}
+	gp := new(GasPool).AddGas(params.GenesisGasLimit)
+
+	results, err := ApplyMessages(evm, msgs, gp)
+	berr, ok := err.(*BatchError)
+	if !ok {
+		t.Fatalf("error type mismatch: have %T (%v), want *BatchError", err, err)
+	}
+	if berr.Index != 2 {
+		t.Errorf("failing index mismatch: have %d, want 2", berr.Index)
+	}
+	if nerr, ok := berr.Err.(*NonceError); !ok || nerr.Unwrap() != ErrNonceTooLow || ErrorKindOf(err) != KindNonceTooLow {
+		t.Errorf("rejection error mismatch: have %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("result count mismatch: have %d, want 2", len(results))
+	}
+	// Each message must have executed with its own origin
+	var used uint64
+	for i, result := range results {
+		if result.Failed() {
+			t.Fatalf("message %d: execution failed: %v", i, result.Err)
+		}
+		if origin := common.BytesToAddress(result.ReturnData); origin != msgs[i].From() {
+			t.Errorf("message %d: origin mismatch: have %x, want %x", i, origin, msgs[i].From())
+		}
+		used += result.UsedGas
+	}
+	// Only the changes of the applied messages may be in the state
+	if have, want := statedb.GetBalance(transitionContract), new(big.Int).Mul(value, big.NewInt(2)); have.Cmp(want) != 0 {
+		t.Errorf("contract balance mismatch: have %v, want %v", have, want)
+	}
+	if nonce := statedb.GetNonce(transitionSender); nonce != 1 {
+		t.Errorf("sender nonce mismatch: have %d, want 1", nonce)
+	}
+	if gp.Gas() != params.GenesisGasLimit-used {
+		t.Errorf("gas pool mismatch: have %d, want %d", gp.Gas(), params.GenesisGasLimit-used)
+	}
+}
+
+// Tests that gas accounting validation accepts correct totals for batches mixing
+// priced and gas-free messages, and rejects wrong totals and invalid messages.
+func TestValidateGasAccounting(t *testing.T) {
+	// PUSH1 1, PUSH1 0, SSTORE: 3 + 3 + 20000 gas on a fresh slot
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE)}
+	batch := func(nonces ...uint64) []Message {
+		return []Message{
+			types.NewMessage(transitionSender, &transitionCoinbase, nonces[0], big.NewInt(1), 50000, big.NewInt(1), nil, true),
+			types.NewMessage(transitionSender, &transitionContract, nonces[1], big.NewInt(0), 50000, big.NewInt(0), nil, true),
+			types.NewMessage(transitionSender, &transitionContract, nonces[2], big.NewInt(0), 50000, big.NewInt(2), []byte{0, 1}, true),
+		}
+	}
+	// The second call writes an already set slot: 3 + 3 + 5000 gas
+	expected := params.TxGas +
+		params.TxGas + 20006 +
+		params.TxGas + params.TxDataZeroGas + params.TxDataNonZeroGas + 5006
+
+	tests := []struct {
+		msgs     []Message
+		expected uint64
+		ok       bool
+	}{
+		{batch(0, 1, 2), expected, true},
+		{batch(0, 1, 2), expected - 1, false},
+		{batch(0, 1, 2), expected + 1, false},
+		{batch(0, 1, 1), expected, false},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, code)
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+
+		err := ValidateGasAccounting(evm, tt.msgs, new(GasPool).AddGas(params.GenesisGasLimit), tt.expected)
+		if tt.ok && err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("test %d: expected error", i)
+		}
+	}
+}
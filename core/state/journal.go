@@ -120,6 +120,9 @@ type (
 	refundChange struct {
 		prev uint64
 	}
+	growthChange struct {
+		prev int64
+	}
 	addLogChange struct {
 		txhash common.Hash
 	}
@@ -211,6 +214,14 @@ func (ch refundChange) dirtied() *common.Address {
 	return nil
 }
 
+func (ch growthChange) revert(s *StateDB) {
+	s.growth = ch.prev
+}
+
+func (ch growthChange) dirtied() *common.Address {
+	return nil
+}
+
 func (ch addLogChange) revert(s *StateDB) {
 	logs := s.logs[ch.txhash]
 	if len(logs) == 1 {
@@ -184,12 +184,20 @@ func (self *stateObject) GetState(db Database, key common.Hash) common.Hash {
 
 // SetState updates a value in account storage.
 func (self *stateObject) SetState(db Database, key, value common.Hash) {
+	prev := self.GetState(db, key)
 	self.db.journal.append(storageChange{
 		account:  &self.address,
 		key:      key,
-		prevalue: self.GetState(db, key),
+		prevalue: prev,
 	})
 	self.setState(key, value)
+
+	switch {
+	case prev == (common.Hash{}) && value != (common.Hash{}):
+		self.db.addGrowth(storageSlotSize)
+	case prev != (common.Hash{}) && value == (common.Hash{}):
+		self.db.addGrowth(-storageSlotSize)
+	}
 }
 
 func (self *stateObject) setState(key, value common.Hash) {
@@ -319,6 +327,10 @@ func (self *stateObject) SetCode(codeHash common.Hash, code []byte) {
 		prevcode: prevcode,
 	})
 	self.setCode(codeHash, code)
+
+	if size := int64(len(code) - len(prevcode)); size != 0 {
+		self.db.addGrowth(size)
+	}
 }
 
 func (self *stateObject) setCode(codeHash common.Hash, code []byte) {
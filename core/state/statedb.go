@@ -36,6 +36,16 @@ type revision struct {
 	journalIndex int
 }
 
+const (
+	// accountSize is the approximate number of bytes a new account adds to the
+	// state: the hashed trie key plus nonce, balance, storage root and code hash.
+	accountSize = 32 + 8 + 32 + 32 + 32
+
+	// storageSlotSize is the approximate number of bytes a new non-zero storage
+	// slot adds to the state: the hashed trie key plus the value.
+	storageSlotSize = 32 + 32
+)
+
 var (
 	// emptyState is the known hash of an empty state trie entry.
 	emptyState = crypto.Keccak256Hash(nil)
@@ -67,6 +77,10 @@ type StateDB struct {
 	// The refund counter, also used by state transitioning.
 	refund uint64
 
+	// The approximate number of bytes of state added since the state db was
+	// created. Used by state transitioning to limit state growth.
+	growth int64
+
 	thash, bhash common.Hash
 	txIndex      int
 	logs         map[common.Hash][]*types.Log
@@ -174,6 +188,12 @@ func (self *StateDB) AddRefund(gas uint64) {
 	self.refund += gas
 }
 
+// addGrowth adjusts the state growth counter by the given number of bytes.
+func (self *StateDB) addGrowth(size int64) {
+	self.journal.append(growthChange{prev: self.growth})
+	self.growth += size
+}
+
 // Exist reports whether the given account address exists in the state.
 // Notably this also returns true for suicided accounts.
 func (self *StateDB) Exist(addr common.Address) bool {
@@ -406,6 +426,7 @@ func (self *StateDB) createObject(addr common.Address) (newobj, prev *stateObjec
 	newobj.setNonce(0) // sets the object to dirty
 	if prev == nil {
 		self.journal.append(createObjectChange{account: &addr})
+		self.addGrowth(accountSize)
 	} else {
 		self.journal.append(resetObjectChange{prev: prev})
 	}
@@ -464,6 +485,7 @@ func (self *StateDB) Copy() *StateDB {
 		stateObjects:      make(map[common.Address]*stateObject, len(self.journal.dirties)),
 		stateObjectsDirty: make(map[common.Address]struct{}, len(self.journal.dirties)),
 		refund:            self.refund,
+		growth:            self.growth,
 		logs:              make(map[common.Hash][]*types.Log, len(self.logs)),
 		logSize:           self.logSize,
 		preimages:         make(map[common.Hash][]byte),
@@ -513,11 +535,8 @@ func (self *StateDB) Snapshot() int {
 
 // RevertToSnapshot reverts all state changes made since the given revision.
 func (self *StateDB) RevertToSnapshot(revid int) {
-	// Find the snapshot in the stack of valid snapshots.
-	idx := sort.Search(len(self.validRevisions), func(i int) bool {
-		return self.validRevisions[i].id >= revid
-	})
-	if idx == len(self.validRevisions) || self.validRevisions[idx].id != revid {
+	idx := self.revisionIndex(revid)
+	if idx < 0 {
 		panic(fmt.Errorf("revision id %v cannot be reverted", revid))
 	}
 	snapshot := self.validRevisions[idx].journalIndex
@@ -527,11 +546,63 @@ func (self *StateDB) RevertToSnapshot(revid int) {
 	self.validRevisions = self.validRevisions[:idx]
 }
 
+// revisionIndex returns the position of the given revision in the stack of
+// valid snapshots, or -1 if it's not a valid revision.
+func (self *StateDB) revisionIndex(revid int) int {
+	idx := sort.Search(len(self.validRevisions), func(i int) bool {
+		return self.validRevisions[i].id >= revid
+	})
+	if idx == len(self.validRevisions) || self.validRevisions[idx].id != revid {
+		return -1
+	}
+	return idx
+}
+
+// ModifiedStorage returns the storage slots written since the given revision,
+// grouped by account in the order they were first written. Writes that have
+// been reverted in the meantime are not included. It returns nil if the
+// revision is no longer valid, e.g. because the state has been finalised.
+func (self *StateDB) ModifiedStorage(revid int) map[common.Address][]common.Hash {
+	idx := self.revisionIndex(revid)
+	if idx < 0 {
+		return nil
+	}
+	var (
+		modified = make(map[common.Address][]common.Hash)
+		seen     = make(map[common.Address]map[common.Hash]struct{})
+	)
+	for _, entry := range self.journal.entries[self.validRevisions[idx].journalIndex:] {
+		change, ok := entry.(storageChange)
+		if !ok {
+			continue
+		}
+		addr := *change.account
+		if seen[addr] == nil {
+			seen[addr] = make(map[common.Hash]struct{})
+		}
+		if _, ok := seen[addr][change.key]; ok {
+			continue
+		}
+		seen[addr][change.key] = struct{}{}
+		modified[addr] = append(modified[addr], change.key)
+	}
+	return modified
+}
+
 // GetRefund returns the current value of the refund counter.
 func (self *StateDB) GetRefund() uint64 {
 	return self.refund
 }
 
+// StateGrowth returns the approximate number of bytes of state added since the
+// state db was created. Accounts are counted when created, storage slots when
+// set and uncounted when cleared, and code by its size change, so the value may
+// decrease. Suicided and deleted empty accounts are not uncounted, along with
+// their code and storage. The counter is journalled and follows snapshot reverts.
+func (self *StateDB) StateGrowth() int64 {
+	return self.growth
+}
+
 // Finalise finalises the state by removing the self destructed objects
 // and clears the journal as well as the refunds.
 func (s *StateDB) Finalise(deleteEmptyObjects bool) {
@@ -435,3 +435,36 @@ func TestCopyOfCopy(t *testing.T) {
 		t.Fatalf("2nd copy fail, expected 42, got %v", got)
 	}
 }
+
+func TestStateGrowth(t *testing.T) {
+	state, _ := New(common.Hash{}, NewDatabase(ethdb.NewMemDatabase()))
+	addr := common.BytesToAddress([]byte("growth"))
+
+	state.CreateAccount(addr)
+	if have := state.StateGrowth(); have != accountSize {
+		t.Fatalf("account growth mismatch: have %d, want %d", have, accountSize)
+	}
+	snap := state.Snapshot()
+
+	state.SetCode(addr, []byte{1, 2, 3})
+	state.SetState(addr, common.Hash{1}, common.Hash{1})
+	state.SetState(addr, common.Hash{1}, common.Hash{2})
+	state.SetState(addr, common.Hash{2}, common.Hash{1})
+	if have, want := state.StateGrowth(), int64(accountSize+3+2*storageSlotSize); have != want {
+		t.Fatalf("write growth mismatch: have %d, want %d", have, want)
+	}
+	state.SetState(addr, common.Hash{2}, common.Hash{})
+	if have, want := state.StateGrowth(), int64(accountSize+3+storageSlotSize); have != want {
+		t.Fatalf("clear growth mismatch: have %d, want %d", have, want)
+	}
+	state.RevertToSnapshot(snap)
+	if have := state.StateGrowth(); have != accountSize {
+		t.Fatalf("reverted growth mismatch: have %d, want %d", have, accountSize)
+	}
+	// Suicided accounts are not uncounted
+	state.Suicide(addr)
+	state.Finalise(true)
+	if have := state.StateGrowth(); have != accountSize {
+		t.Fatalf("suicide growth mismatch: have %d, want %d", have, accountSize)
+	}
+}
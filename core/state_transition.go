@@ -17,18 +17,28 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"math"
 	"math/big"
+	"time"
 
 	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/core/types"
 	"github.com/eximchain/go-ethereum/core/vm"
+	"github.com/eximchain/go-ethereum/crypto"
 	"github.com/eximchain/go-ethereum/log"
+	"github.com/eximchain/go-ethereum/metrics"
 	"github.com/eximchain/go-ethereum/params"
 )
 
+// emptyCodeHash is the code hash of accounts without code.
+var emptyCodeHash = crypto.Keccak256Hash(nil)
+
 var (
-	errInsufficientBalanceForGas = errors.New("insufficient balance to pay for gas")
+	transitionPublicCounter  = metrics.NewRegisteredCounter("core/statetransition/public", nil)
+	transitionGasHistogram   = metrics.NewRegisteredHistogram("core/statetransition/gasused", nil, metrics.NewExpDecaySample(1028, 0.015))
+	transitionExecutionTimer = metrics.NewRegisteredTimer("core/statetransition/execution", nil)
 )
 
 /*
@@ -54,10 +64,83 @@ type StateTransition struct {
 	gas        uint64
 	gasPrice   *big.Int
 	initialGas uint64
+	gasPayer   common.Address // Account the gas was bought from, refunded the unused gas
 	value      *big.Int
 	data       []byte
 	state      vm.StateDB
 	evm        *vm.EVM
+
+	overrides   *BlockOverrides // Optional block context overrides, simulation only
+	growthLimit uint64          // Maximum bytes of new state a message may add (0 = unlimited)
+	maxCalldata uint64          // Maximum bytes of data a message may carry (0 = unlimited)
+	expectRoot  *common.Hash    // Intermediate state root to verify after execution
+	maxRefund   uint64          // Ceiling of the refund counter consulted for refunds (0 = unlimited)
+	trackStore  bool            // Whether to collect the storage slots modified by the message
+	logFees     bool            // Whether to log the money flow of the message
+	unmetered   bool            // Whether to keep the transition out of the metrics, e.g. for estimates
+
+	intrinsicExempt func(from common.Address) bool // Optional intrinsic gas exemption per sender
+
+	feeRecipient *common.Address                        // Account credited with the fee instead of the coinbase
+	feeHook      func(statedb vm.StateDB, fee *big.Int) // Optional fee distribution replacing the credit
+}
+
+// BlockOverrides contains optional replacements for the block context a state
+// transition executes in. Nil fields keep the value already set on the EVM.
+//
+// Overrides are not part of consensus. They exist to simulate messages at
+// hypothetical block numbers or timestamps (e.g. to exercise vesting schedules
+// or auctions) and must never be used when processing blocks.
+type BlockOverrides struct {
+	Number   *big.Int // Block number, also selecting the active fork rules
+	Time     *big.Int // Block timestamp
+	GasLimit *uint64  // Block gas limit as seen by the GASLIMIT opcode
+}
+
+// ExecutionResult is the outcome of applying a message, whether the EVM
+// execution itself succeeded or not.
+type ExecutionResult struct {
+	ReturnData      []byte         // Data returned by the EVM, including revert data
+	UsedGas         uint64         // Gas used by the message, refunds already deducted
+	RefundedGas     uint64         // Gas refunded from the refund counter
+	Err             error          // Error the EVM execution failed with, if any
+	ContractAddress common.Address // Address of the created contract, if the message is a creation
+	Interpreter     vm.Interpreter // Interpreter that ran the top level code, nil if no code ran
+
+	// RefundCounterDelta is the amount the state's refund counter grew by while
+	// executing the message, e.g. through storage clearing. Unlike RefundedGas,
+	// it is not capped by the gas used.
+	RefundCounterDelta uint64
+
+	// EffectiveGasPrice is the gas price the fee of the message was actually
+	// calculated with, as reported in receipts.
+	EffectiveGasPrice *big.Int
+
+	// ModifiedStorage contains the storage slots written by the message, grouped
+	// by account, if storage tracking was enabled. Writes of reverted calls are
+	// not included.
+	ModifiedStorage map[common.Address][]common.Hash
+
+	// FailedTransfers is the number of value transfers of nested calls and
+	// contract creations that failed due to insufficient balance. Unlike a
+	// failing top level transfer these don't invalidate the message, the
+	// calling contract merely observes a failed call.
+	FailedTransfers uint64
+}
+
+// Failed returns whether the EVM execution of the message failed, e.g. because
+// it reverted or ran out of gas. Such messages are still valid.
+func (result *ExecutionResult) Failed() bool {
+	return result.Err != nil
+}
+
+// Revert returns the data the execution reverted with, usually an ABI encoded
+// revert reason, or nil if it didn't revert. See abi.UnpackRevert for decoding.
+func (result *ExecutionResult) Revert() []byte {
+	if result.Err != vm.ErrExecutionReverted {
+		return nil
+	}
+	return common.CopyBytes(result.ReturnData)
 }
 
 // Message represents a message sent to a contract.
@@ -73,16 +156,40 @@ type Message interface {
 	Nonce() uint64
 	CheckNonce() bool
 	Data() []byte
+	AccessList() types.AccessList
+}
+
+// SponsoredMessage is implemented by messages whose gas is paid for by another
+// account than their sender, e.g. a relayer offering gasless transactions. The
+// sender still signs, pays the value and has its nonce checked and advanced.
+type SponsoredMessage interface {
+	Message
+
+	// GasPayer returns the account paying for gas, or nil if the sender pays.
+	GasPayer() *common.Address
 }
 
 // IntrinsicGas computes the 'intrinsic gas' for a message with the given data.
 func IntrinsicGas(data []byte, contractCreation, homestead bool) (uint64, error) {
+	return intrinsicGas(data, nil, contractCreation, params.DefaultIntrinsicGasSchedule(homestead, false))
+}
+
+// TxIntrinsicGas computes the 'intrinsic gas' for a transaction, priced as per
+// the given schedule, e.g. to validate it in a transaction pool.
+func TxIntrinsicGas(tx *types.Transaction, schedule params.IntrinsicGasSchedule) (uint64, error) {
+	return intrinsicGas(tx.Data(), nil, tx.To() == nil, schedule)
+}
+
+// intrinsicGas computes the 'intrinsic gas' for a message with the given data
+// and access list, priced as per the given schedule. It neither logs nor
+// allocates, so it is cheap to call in tight loops.
+func intrinsicGas(data []byte, accessList types.AccessList, contractCreation bool, schedule params.IntrinsicGasSchedule) (uint64, error) {
 	// Set the starting gas for the raw transaction
 	var gas uint64
-	if contractCreation && homestead {
-		gas = params.TxGasContractCreation
+	if contractCreation {
+		gas = schedule.TxGasContractCreation
 	} else {
-		gas = params.TxGas
+		gas = schedule.TxGas
 	}
 	// Bump the required gas by the amount of transactional data
 	if len(data) > 0 {
@@ -94,16 +201,29 @@ func IntrinsicGas(data []byte, contractCreation, homestead bool) (uint64, error)
 			}
 		}
 		// Make sure we don't exceed uint64 for all data combinations
-		if (math.MaxUint64-gas)/params.TxDataNonZeroGas < nz {
+		if schedule.TxDataNonZeroGas > 0 && (math.MaxUint64-gas)/schedule.TxDataNonZeroGas < nz {
 			return 0, vm.ErrOutOfGas
 		}
-		gas += nz * params.TxDataNonZeroGas
+		gas += nz * schedule.TxDataNonZeroGas
 
 		z := uint64(len(data)) - nz
-		if (math.MaxUint64-gas)/params.TxDataZeroGas < z {
+		if schedule.TxDataZeroGas > 0 && (math.MaxUint64-gas)/schedule.TxDataZeroGas < z {
+			return 0, vm.ErrOutOfGas
+		}
+		gas += z * schedule.TxDataZeroGas
+	}
+	// Charge the accounts and storage slots declared in the access list
+	if len(accessList) > 0 {
+		if (math.MaxUint64-gas)/params.TxAccessListAddressGas < uint64(len(accessList)) {
+			return 0, vm.ErrOutOfGas
+		}
+		gas += uint64(len(accessList)) * params.TxAccessListAddressGas
+
+		keys := uint64(accessList.StorageKeys())
+		if (math.MaxUint64-gas)/params.TxAccessListStorageKeyGas < keys {
 			return 0, vm.ErrOutOfGas
 		}
-		gas += z * params.TxDataZeroGas
+		gas += keys * params.TxAccessListStorageKeyGas
 	}
 	return gas, nil
 }
@@ -132,6 +252,123 @@ func ApplyMessage(evm *vm.EVM, msg Message, gp *GasPool) ([]byte, uint64, bool,
 	return NewStateTransition(evm, msg, gp).TransitionDb()
 }
 
+// ApplyMessageResult is like ApplyMessage, but returns the outcome of the
+// execution as an ExecutionResult.
+func ApplyMessageResult(evm *vm.EVM, msg Message, gp *GasPool) (*ExecutionResult, error) {
+	return NewStateTransition(evm, msg, gp).TransitionDb2()
+}
+
+// ApplyMessageContext is like ApplyMessage, but aborts with ErrExecutionCancelled
+// if the context is cancelled or times out before or during execution.
+func ApplyMessageContext(ctx context.Context, evm *vm.EVM, msg Message, gp *GasPool) ([]byte, uint64, bool, error) {
+	return NewStateTransition(evm, msg, gp).TransitionDbContext(ctx)
+}
+
+// SetBlockOverrides sets the block context overrides applied to the EVM before
+// the message is executed. It is meant for simulation only.
+func (st *StateTransition) SetBlockOverrides(overrides *BlockOverrides) {
+	st.overrides = overrides
+}
+
+// SetStateGrowthLimit sets the maximum number of bytes of new state, as measured
+// by the state db, that executing the message may add. Messages exceeding it are
+// rejected with ErrStateGrowthLimitExceeded and all their changes are reverted.
+// A limit of zero disables the check. It requires a state db accounting for
+// state growth.
+func (st *StateTransition) SetStateGrowthLimit(limit uint64) {
+	st.growthLimit = limit
+}
+
+// SetMaxCalldataSize sets the maximum number of bytes of data a message may
+// carry, e.g. params.MaxCalldataSize. Larger messages are rejected with
+// ErrCalldataTooLarge before their intrinsic gas is computed. The limit is not
+// part of consensus, so it is disabled by default and must not be set when
+// processing blocks. A limit of zero disables the check.
+func (st *StateTransition) SetMaxCalldataSize(size uint64) {
+	st.maxCalldata = size
+}
+
+// SetExpectedRoot enables verifying the intermediate state root after the message
+// is applied against the given root, e.g. the one recorded in a pre-Byzantium
+// receipt. On divergence ErrStateRootMismatch is returned. Computing the root
+// finalises the state, so the check is expensive and meant for verification
+// and debugging only. It requires a state db able to compute intermediate roots.
+func (st *StateTransition) SetExpectedRoot(root common.Hash) {
+	st.expectRoot = &root
+}
+
+// SetMaxRefund sets an absolute ceiling on the refund counter consulted when
+// refunding gas, on top of the cap of half the gas used. It hardens refunds
+// against messages accumulating huge refund counters. Zero disables it.
+func (st *StateTransition) SetMaxRefund(max uint64) {
+	st.maxRefund = max
+}
+
+// SetTrackStorage sets whether the storage slots modified by the message should
+// be collected for state diffs, see ExecutionResult.ModifiedStorage. It requires
+// a state db tracking modifications.
+func (st *StateTransition) SetTrackStorage(track bool) {
+	st.trackStore = track
+}
+
+// SetIntrinsicGasExemption installs a callback deciding whether the sender of
+// the message is exempt from paying intrinsic gas, e.g. for whitelisted senders
+// with sponsored gas on permissioned chains. Exemptions alter gas accounting
+// and are not consensus rules: every node of a chain must use the same callback.
+func (st *StateTransition) SetIntrinsicGasExemption(exempt func(from common.Address) bool) {
+	st.intrinsicExempt = exempt
+}
+
+// SetFeeRecipient sets the account credited with the fee of the message instead
+// of the coinbase, e.g. a treasury contract. Like intrinsic gas exemptions, fee
+// routing is not a consensus rule: every node of a chain must route alike.
+func (st *StateTransition) SetFeeRecipient(recipient common.Address) {
+	st.feeRecipient = &recipient
+}
+
+// SetFeeHook installs a callback distributing the fee of the message in place
+// of crediting it to the fee recipient, e.g. to split it between accounts or to
+// burn it. The refund of unused gas to the sender is not affected.
+func (st *StateTransition) SetFeeHook(hook func(statedb vm.StateDB, fee *big.Int)) {
+	st.feeHook = hook
+}
+
+// SetLogFees sets whether a summary of the money flow of the message, i.e. the
+// gas debited from the sender, the fee credited to the coinbase and the gas
+// refunded to the sender, all in wei, should be logged for auditing.
+func (st *StateTransition) SetLogFees(enabled bool) {
+	st.logFees = enabled
+}
+
+// applyBlockOverrides replaces the EVM block context with the configured
+// overrides, if any. It returns a function restoring the original context, so
+// that later messages executed on the same EVM are not affected.
+func (st *StateTransition) applyBlockOverrides() (restore func()) {
+	if st.overrides == nil {
+		return func() {}
+	}
+	original := st.evm.Context
+	restore = func() {
+		st.evm.SetBlockContext(original.BlockNumber, original.Time, original.GasLimit)
+	}
+	var (
+		number   = st.evm.BlockNumber
+		time     = st.evm.Time
+		gasLimit = st.evm.GasLimit
+	)
+	if st.overrides.Number != nil {
+		number = new(big.Int).Set(st.overrides.Number)
+	}
+	if st.overrides.Time != nil {
+		time = new(big.Int).Set(st.overrides.Time)
+	}
+	if st.overrides.GasLimit != nil {
+		gasLimit = *st.overrides.GasLimit
+	}
+	st.evm.SetBlockContext(number, time, gasLimit)
+	return restore
+}
+
 // to returns the recipient of the message.
 func (st *StateTransition) to() common.Address {
 	if st.msg == nil || st.msg.To() == nil /* contract creation */ {
@@ -149,10 +386,23 @@ func (st *StateTransition) useGas(amount uint64) error {
 	return nil
 }
 
+// payer returns the account paying for the gas of the message, which is its
+// sender unless the message is sponsored.
+func (st *StateTransition) payer() common.Address {
+	if msg, ok := st.msg.(SponsoredMessage); ok {
+		if payer := msg.GasPayer(); payer != nil {
+			return *payer
+		}
+	}
+	return st.msg.From()
+}
+
 func (st *StateTransition) buyGas() error {
+	st.gasPayer = st.payer()
+
 	mgval := new(big.Int).Mul(new(big.Int).SetUint64(st.msg.Gas()), st.gasPrice)
-	if st.state.GetBalance(st.msg.From()).Cmp(mgval) < 0 {
-		return errInsufficientBalanceForGas
+	if !st.freeGas() && st.state.GetBalance(st.gasPayer).Cmp(mgval) < 0 {
+		return &GasPayerError{Payer: st.gasPayer}
 	}
 	if err := st.gp.SubGas(st.msg.Gas()); err != nil {
 		return err
@@ -160,18 +410,39 @@ func (st *StateTransition) buyGas() error {
 	st.gas += st.msg.Gas()
 
 	st.initialGas = st.msg.Gas()
-	st.state.SubBalance(st.msg.From(), mgval)
+	if !st.freeGas() {
+		st.state.SubBalance(st.gasPayer, mgval)
+	}
 	return nil
 }
 
+// freeGas returns whether the message pays no gas fee at all, in which case the
+// balances of the gas payer and the coinbase are not checked or updated. Before
+// EIP158 a zero credit still created an absent coinbase account, so balances are
+// only skipped once empty accounts are removed anyway.
+func (st *StateTransition) freeGas() bool {
+	return st.gasPrice.Sign() == 0 && st.evm.ChainConfig().IsEIP158(st.evm.BlockNumber)
+}
+
+// touch marks an account as touched without changing its balance, as the zero
+// credits of priced messages do. Touched empty accounts are deleted under
+// EIP158, so skipping the touch would make the state root diverge.
+func (st *StateTransition) touch(addr common.Address) {
+	st.state.AddBalance(addr, new(big.Int))
+}
+
 func (st *StateTransition) preCheck() error {
 	// Make sure this transaction's nonce is correct.
 	if st.msg.CheckNonce() {
 		nonce := st.state.GetNonce(st.msg.From())
-		if nonce < st.msg.Nonce() {
-			return ErrNonceTooHigh
-		} else if nonce > st.msg.Nonce() {
-			return ErrNonceTooLow
+		if nonce != st.msg.Nonce() {
+			return &NonceError{Want: nonce, Got: st.msg.Nonce()}
+		}
+		// Make sure the sender is an externally owned account (EIP-3607)
+		if st.evm.ChainConfig().IsEIP3607(st.evm.BlockNumber) {
+			if codeHash := st.state.GetCodeHash(st.msg.From()); codeHash != emptyCodeHash && codeHash != (common.Hash{}) {
+				return ErrSenderNoEOA
+			}
 		}
 	}
 	return st.buyGas()
@@ -181,67 +452,379 @@ func (st *StateTransition) preCheck() error {
 // returning the result including the used gas. It returns an error if failed.
 // An error indicates a consensus issue.
 func (st *StateTransition) TransitionDb() (ret []byte, usedGas uint64, failed bool, err error) {
-	if err = st.preCheck(); err != nil {
-		return
+	return st.TransitionDbContext(context.Background())
+}
+
+// TransitionDbContext is like TransitionDb, but aborts with ErrExecutionCancelled
+// if the context is done before gas is bought, before the EVM is invoked or
+// while it executes. Cancellation is not a consensus error and leaves the
+// state partially modified, callers are expected to discard it.
+func (st *StateTransition) TransitionDbContext(ctx context.Context) (ret []byte, usedGas uint64, failed bool, err error) {
+	result, err := st.transitionDb(ctx)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return result.ReturnData, result.UsedGas, result.Failed(), nil
+}
+
+// TransitionDb2 is like TransitionDb, but returns the outcome of the execution
+// as an ExecutionResult. A returned error indicates a consensus issue, whereas
+// errors of the EVM execution are reported in the result.
+func (st *StateTransition) TransitionDb2() (*ExecutionResult, error) {
+	return st.transitionDb(context.Background())
+}
+
+// transitionDb implements TransitionDbContext and TransitionDb2.
+func (st *StateTransition) transitionDb(ctx context.Context) (result *ExecutionResult, err error) {
+	if ctx.Err() != nil {
+		return nil, ErrExecutionCancelled
+	}
+	defer st.applyBlockOverrides()()
+
+	// Reject oversized messages before iterating over their data
+	if err := st.checkCalldataSize(); err != nil {
+		return nil, err
+	}
+	// Return any gas bought from the gas pool if the message is rejected, so
+	// that it remains available to the next message of the block
+	available := st.gp.Gas()
+	defer func() {
+		if err != nil {
+			st.gp.AddGas(available - st.gp.Gas())
+		}
+	}()
+
+	var (
+		snapshot int
+		growth   int64
+		refund   = st.state.GetRefund()
+	)
+	tracker, tracksGrowth := st.state.(growthTracker)
+	if tracksGrowth {
+		growth = tracker.StateGrowth()
+	}
+	if st.growthLimit > 0 || st.trackStore {
+		snapshot = st.state.Snapshot()
+	}
+
+	if err := st.preCheck(); err != nil {
+		return nil, err
 	}
 	msg := st.msg
 	sender := vm.AccountRef(msg.From())
-	homestead := st.evm.ChainConfig().IsHomestead(st.evm.BlockNumber)
 	contractCreation := msg.To() == nil
 
-	// Pay intrinsic gas
-	gas, err := IntrinsicGas(st.data, contractCreation, homestead)
-	if err != nil {
-		return nil, 0, false, err
+	if err := st.useIntrinsicGas(); err != nil {
+		return nil, err
 	}
-	if err = st.useGas(gas); err != nil {
-		return nil, 0, false, err
+
+	if ctx.Err() != nil {
+		return nil, ErrExecutionCancelled
 	}
+	// Abort the EVM if the context is done while executing
+	stop := st.watchContext(ctx)
 
 	var (
 		evm = st.evm
 		// vm errors do not effect consensus and are therefor
 		// not assigned to err, except for insufficient balance
 		// error.
-		vmerr error
+		ret     []byte
+		address common.Address
+		vmerr   error
+
+		transfers = evm.FailedTransfers()
+		start     = time.Now()
 	)
 	if contractCreation {
-		ret, _, st.gas, vmerr = evm.Create(sender, st.data, st.gas, st.value)
+		ret, address, st.gas, vmerr = evm.Create(sender, st.data, st.gas, st.value)
 	} else {
 		// Increment the nonce for the next transaction
 		st.state.SetNonce(msg.From(), st.state.GetNonce(sender.Address())+1)
 		ret, st.gas, vmerr = evm.Call(sender, st.to(), st.data, st.gas, st.value)
 	}
-	if vmerr != nil {
-		log.Debug("VM returned with error", "err", vmerr)
-		// The only possible consensus-error would be if there wasn't
-		// sufficient balance to make the transfer happen. The first
-		// balance transfer may never fail.
-		if vmerr == vm.ErrInsufficientBalance {
-			return nil, 0, false, vmerr
+	stop()
+	if !st.unmetered {
+		transitionExecutionTimer.UpdateSince(start)
+	}
+	failedTransfers := evm.FailedTransfers() - transfers
+
+	if ctx.Err() != nil {
+		return nil, ErrExecutionCancelled
+	}
+	// The only possible consensus-error would be if there wasn't
+	// sufficient balance to make the transfer happen. The first
+	// balance transfer may never fail.
+	if vmerr == vm.ErrInsufficientBalance {
+		return nil, vmerr
+	}
+	if st.growthLimit > 0 && tracksGrowth && tracker.StateGrowth()-growth > int64(st.growthLimit) {
+		st.state.RevertToSnapshot(snapshot)
+		return nil, ErrStateGrowthLimitExceeded
+	}
+	refundDelta := st.state.GetRefund() - refund
+
+	var modified map[common.Address][]common.Hash
+	if tracker, ok := st.state.(storageTracker); ok && st.trackStore {
+		modified = tracker.ModifiedStorage(snapshot)
+	}
+	refunded := st.refundGas()
+
+	// Credit the fee to the coinbase. If the sender is also the coinbase, the
+	// full gas allowance was debited up front and is returned here and in the
+	// refund, so the final balance only reflects the transferred value. Code
+	// reading the sender's balance during execution does observe the debit.
+	if !st.freeGas() {
+		st.payFee(new(big.Int).Mul(new(big.Int).SetUint64(st.gasUsed()), st.gasPrice))
+	} else if st.feeHook == nil {
+		st.touch(st.feeAccount())
+	}
+
+	if st.logFees {
+		st.logFeeBreakdown()
+	}
+
+	if st.expectRoot != nil {
+		if err := st.verifyRoot(); err != nil {
+			return nil, err
+		}
+	}
+	log.Debug("Applied message", "gas", st.gasUsed(), "failedTransfers", failedTransfers, "err", vmerr)
+
+	if !st.unmetered {
+		transitionPublicCounter.Inc(1)
+		transitionGasHistogram.Update(int64(st.gasUsed()))
+	}
+
+	return &ExecutionResult{
+		ReturnData:         ret,
+		UsedGas:            st.gasUsed(),
+		RefundedGas:        refunded,
+		Err:                vmerr,
+		ContractAddress:    address,
+		Interpreter:        st.evm.ExecutedInterpreter(),
+		RefundCounterDelta: refundDelta,
+		EffectiveGasPrice:  new(big.Int).Set(st.gasPrice),
+		ModifiedStorage:    modified,
+		FailedTransfers:    failedTransfers,
+	}, nil
+}
+
+// Simulate executes the message without its side effects, e.g. to preview a
+// transaction. No gas is bought or refunded, the nonce of the sender is not
+// incremented, the coinbase is not credited and all state changes made while
+// executing are reverted afterwards. The gas pool is left untouched too.
+//
+// The message runs with its full gas allowance regardless of the sender's
+// balance, so the reported gas usage is only an estimate of what applying the
+// message would use.
+func (st *StateTransition) Simulate() (*ExecutionResult, error) {
+	defer st.applyBlockOverrides()()
+
+	if err := st.checkCalldataSize(); err != nil {
+		return nil, err
+	}
+	st.gas = st.msg.Gas()
+	st.initialGas = st.msg.Gas()
+	if err := st.useIntrinsicGas(); err != nil {
+		return nil, err
+	}
+	var (
+		evm      = st.evm
+		sender   = vm.AccountRef(st.msg.From())
+		snapshot = st.state.Snapshot()
+		counter  = st.state.GetRefund()
+
+		ret     []byte
+		address common.Address
+		vmerr   error
+	)
+	if st.msg.To() == nil {
+		ret, address, st.gas, vmerr = evm.Create(sender, st.data, st.gas, st.value)
+	} else {
+		ret, st.gas, vmerr = evm.Call(sender, st.to(), st.data, st.gas, st.value)
+	}
+
+	// Apply the refund counter before it is reverted
+	refund := st.refundable()
+	refundDelta := st.state.GetRefund() - counter
+	st.gas += refund
+	st.state.RevertToSnapshot(snapshot)
+
+	if vmerr == vm.ErrInsufficientBalance {
+		return nil, vmerr
+	}
+	return &ExecutionResult{
+		ReturnData:         ret,
+		UsedGas:            st.gasUsed(),
+		RefundedGas:        refund,
+		Err:                vmerr,
+		ContractAddress:    address,
+		Interpreter:        st.evm.ExecutedInterpreter(),
+		RefundCounterDelta: refundDelta,
+		EffectiveGasPrice:  new(big.Int).Set(st.gasPrice),
+	}, nil
+}
+
+// watchContext cancels the EVM once the context is done, until the returned stop
+// function is called. Stop waits for the watcher to exit, so the EVM is never
+// cancelled after it returned.
+func (st *StateTransition) watchContext(ctx context.Context) (stop func()) {
+	done := ctx.Done()
+	if done == nil {
+		return func() {}
+	}
+	var (
+		finished = make(chan struct{})
+		stopped  = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-done:
+			st.evm.Cancel()
+		case <-finished:
 		}
+	}()
+	return func() {
+		close(finished)
+		<-stopped
+	}
+}
+
+// checkCalldataSize returns ErrCalldataTooLarge if the data of the message
+// exceeds the configured limit.
+func (st *StateTransition) checkCalldataSize() error {
+	if st.maxCalldata > 0 && uint64(len(st.data)) > st.maxCalldata {
+		return ErrCalldataTooLarge
+	}
+	return nil
+}
+
+// useIntrinsicGas deducts the intrinsic gas of the message from the gas left,
+// unless the sender is exempt.
+func (st *StateTransition) useIntrinsicGas() error {
+	if st.intrinsicExempt != nil && st.intrinsicExempt(st.msg.From()) {
+		return nil
 	}
-	st.refundGas()
-	st.state.AddBalance(st.evm.Coinbase, new(big.Int).Mul(new(big.Int).SetUint64(st.gasUsed()), st.gasPrice))
+	schedule := st.evm.ChainConfig().IntrinsicGasSchedule(st.evm.BlockNumber)
+	gas, err := intrinsicGas(st.data, st.msg.AccessList(), st.msg.To() == nil, schedule)
+	if err != nil {
+		return err
+	}
+	if err = st.useGas(gas); err != nil {
+		return ErrIntrinsicGas
+	}
+	return nil
+}
+
+// growthTracker is implemented by state databases accounting for the number of
+// bytes of state added.
+type growthTracker interface {
+	StateGrowth() int64
+}
+
+// storageTracker is implemented by state databases able to report the storage
+// slots modified since a snapshot.
+type storageTracker interface {
+	ModifiedStorage(revid int) map[common.Address][]common.Hash
+}
+
+// intermediateRooter is implemented by state databases able to compute the
+// current state root.
+type intermediateRooter interface {
+	IntermediateRoot(deleteEmptyObjects bool) common.Hash
+}
 
-	return ret, st.gasUsed(), vmerr != nil, err
+// verifyRoot checks the intermediate state root against the expected one.
+func (st *StateTransition) verifyRoot() error {
+	rooter, ok := st.state.(intermediateRooter)
+	if !ok {
+		return errors.New("state root verification not supported by state")
+	}
+	root := rooter.IntermediateRoot(st.evm.ChainConfig().IsEIP158(st.evm.BlockNumber))
+	if root != *st.expectRoot {
+		log.Warn("Intermediate state root mismatch", "have", root, "want", *st.expectRoot)
+		return ErrStateRootMismatch
+	}
+	return nil
 }
 
-func (st *StateTransition) refundGas() {
-	// Apply refund counter, capped to half of the used gas.
-	refund := st.gasUsed() / 2
-	if refund > st.state.GetRefund() {
-		refund = st.state.GetRefund()
+// refundable returns the gas refunded from the refund counter, capped to half
+// of the used gas (a fifth from London onwards as per EIP-3529) and to the
+// configured ceiling, if any.
+func (st *StateTransition) refundable() uint64 {
+	counter := st.state.GetRefund()
+	if st.maxRefund > 0 && counter > st.maxRefund {
+		counter = st.maxRefund
+	}
+	quotient := params.RefundQuotient
+	if st.evm.ChainConfig().IsLondon(st.evm.BlockNumber) {
+		quotient = params.RefundQuotientEIP3529
+	}
+	refund := st.gasUsed() / quotient
+	if refund > counter {
+		refund = counter
 	}
+	return refund
+}
+
+// refundGas returns the gas left, including refunds, to the account the gas was
+// bought from and to the gas pool, the latter even if the message pays no gas
+// fee. It returns the amount of gas refunded from the refund counter.
+func (st *StateTransition) refundGas() uint64 {
+	// Apply refund counter
+	refund := st.refundable()
 	st.gas += refund
 
 	// Return ETH for remaining gas, exchanged at the original rate.
-	remaining := new(big.Int).Mul(new(big.Int).SetUint64(st.gas), st.gasPrice)
-	st.state.AddBalance(st.msg.From(), remaining)
+	if !st.freeGas() {
+		remaining := new(big.Int).Mul(new(big.Int).SetUint64(st.gas), st.gasPrice)
+		st.state.AddBalance(st.gasPayer, remaining)
+	} else {
+		st.touch(st.gasPayer)
+	}
 
 	// Also return remaining gas to the block gas counter so it is
 	// available for the next transaction.
 	st.gp.AddGas(st.gas)
+
+	return refund
+}
+
+// payFee distributes the fee of the message through the fee hook if set, or
+// credits it to the fee recipient otherwise.
+func (st *StateTransition) payFee(fee *big.Int) {
+	if st.feeHook != nil {
+		st.feeHook(st.state, fee)
+		return
+	}
+	st.state.AddBalance(st.feeAccount(), fee)
+}
+
+// feeAccount returns the account credited with the fee absent a fee hook.
+func (st *StateTransition) feeAccount() common.Address {
+	if st.feeRecipient != nil {
+		return *st.feeRecipient
+	}
+	return st.evm.Coinbase
+}
+
+// logFeeBreakdown logs the wei debited from the gas payer for gas, paid as fee
+// and refunded to the gas payer for unused gas. Fees distributed by a fee hook
+// are logged without recipient.
+func (st *StateTransition) logFeeBreakdown() {
+	var (
+		debit  = new(big.Int).Mul(new(big.Int).SetUint64(st.initialGas), st.gasPrice)
+		fee    = new(big.Int).Mul(new(big.Int).SetUint64(st.gasUsed()), st.gasPrice)
+		refund = new(big.Int).Mul(new(big.Int).SetUint64(st.gas), st.gasPrice)
+	)
+	ctx := []interface{}{"from", st.msg.From(), "payer", st.gasPayer, "debit", debit, "fee", fee, "refund", refund}
+	if st.feeHook == nil {
+		ctx = append(ctx, "recipient", st.feeAccount())
+	}
+	log.Info("Transaction fees", ctx...)
 }
 
 // gasUsed returns the amount of gas used up by the state transition.
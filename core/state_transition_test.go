@@ -0,0 +1,1698 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/eximchain/go-ethereum/accounts/abi"
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/core/state"
+	"github.com/eximchain/go-ethereum/core/types"
+	"github.com/eximchain/go-ethereum/core/vm"
+	"github.com/eximchain/go-ethereum/crypto"
+	"github.com/eximchain/go-ethereum/ethdb"
+	"github.com/eximchain/go-ethereum/log"
+	"github.com/eximchain/go-ethereum/metrics"
+	"github.com/eximchain/go-ethereum/params"
+)
+
+var (
+	transitionSender   = common.HexToAddress("0x1000000000000000000000000000000000000001")
+	transitionContract = common.HexToAddress("0x2000000000000000000000000000000000000002")
+	transitionCoinbase = common.HexToAddress("0x3000000000000000000000000000000000000003")
+)
+
+// newTransitionTestState creates an in-memory state with a funded sender.
+func newTransitionTestState() *state.StateDB {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(ethdb.NewMemDatabase()))
+	statedb.AddBalance(transitionSender, new(big.Int).Mul(big.NewInt(1000), big.NewInt(params.Ether)))
+	return statedb
+}
+
+// newTransitionTestEVM creates an EVM executing at the given block number.
+func newTransitionTestEVM(config *params.ChainConfig, number uint64, statedb vm.StateDB) *vm.EVM {
+	context := vm.Context{
+		CanTransfer: CanTransfer,
+		Transfer:    Transfer,
+		GetHash:     func(uint64) common.Hash { return common.Hash{} },
+		Origin:      transitionSender,
+		Coinbase:    transitionCoinbase,
+		BlockNumber: new(big.Int).SetUint64(number),
+		Time:        big.NewInt(0),
+		Difficulty:  big.NewInt(0),
+		GasLimit:    params.GenesisGasLimit,
+		GasPrice:    big.NewInt(1),
+	}
+	return vm.NewEVM(context, statedb, config, vm.Config{})
+}
+
+// Tests that block number overrides select the fork rules of the overridden
+// block, both for intrinsic gas and for the EVM instruction set.
+func TestBlockOverridesAcrossForkBoundary(t *testing.T) {
+	config := &params.ChainConfig{
+		ChainID:        big.NewInt(1),
+		HomesteadBlock: big.NewInt(10),
+		ByzantiumBlock: big.NewInt(10),
+	}
+	// RETURNDATASIZE, STOP: only valid from Byzantium onwards
+	code := []byte{byte(vm.RETURNDATASIZE), byte(vm.STOP)}
+
+	tests := []struct {
+		number   *big.Int
+		creation uint64
+		failed   bool
+	}{
+		{nil, params.TxGas, true},
+		{big.NewInt(9), params.TxGas, true},
+		{big.NewInt(10), params.TxGasContractCreation, false},
+		{big.NewInt(100), params.TxGasContractCreation, false},
+	}
+	for i, tt := range tests {
+		// Contract creation intrinsic gas depends on Homestead
+		statedb := newTransitionTestState()
+		evm := newTransitionTestEVM(config, 1, statedb)
+		msg := types.NewMessage(transitionSender, nil, 0, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+
+		st := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		st.SetBlockOverrides(&BlockOverrides{Number: tt.number})
+		if _, gas, _, err := st.TransitionDb(); err != nil {
+			t.Fatalf("test %d: creation failed: %v", i, err)
+		} else if gas != tt.creation {
+			t.Errorf("test %d: creation gas mismatch: have %d, want %d", i, gas, tt.creation)
+		}
+		// Opcode availability depends on Byzantium
+		statedb = newTransitionTestState()
+		statedb.SetCode(transitionContract, code)
+		evm = newTransitionTestEVM(config, 1, statedb)
+		msg = types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+
+		st = NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		st.SetBlockOverrides(&BlockOverrides{Number: tt.number})
+		if _, _, failed, err := st.TransitionDb(); err != nil {
+			t.Fatalf("test %d: call failed: %v", i, err)
+		} else if failed != tt.failed {
+			t.Errorf("test %d: call failure mismatch: have %v, want %v", i, failed, tt.failed)
+		}
+	}
+}
+
+// Tests that timestamp and gas limit overrides are visible to the executing
+// contract while unset fields keep the original block context.
+func TestBlockOverridesContext(t *testing.T) {
+	// TIMESTAMP, PUSH1 0, SSTORE, GASLIMIT, PUSH1 1, SSTORE, NUMBER, PUSH1 2, SSTORE
+	code := []byte{
+		byte(vm.TIMESTAMP), byte(vm.PUSH1), 0, byte(vm.SSTORE),
+		byte(vm.GASLIMIT), byte(vm.PUSH1), 1, byte(vm.SSTORE),
+		byte(vm.NUMBER), byte(vm.PUSH1), 2, byte(vm.SSTORE),
+	}
+	statedb := newTransitionTestState()
+	statedb.SetCode(transitionContract, code)
+
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 5, statedb)
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 200000, big.NewInt(1), nil, true)
+
+	gasLimit := uint64(12345678)
+	st := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas()))
+	st.SetBlockOverrides(&BlockOverrides{Time: big.NewInt(1700000000), GasLimit: &gasLimit})
+	if _, _, failed, err := st.TransitionDb(); err != nil || failed {
+		t.Fatalf("transition failed: failed %v, err %v", failed, err)
+	}
+	if have := statedb.GetState(transitionContract, common.BigToHash(big.NewInt(0))).Big(); have.Uint64() != 1700000000 {
+		t.Errorf("timestamp mismatch: have %v, want %v", have, 1700000000)
+	}
+	if have := statedb.GetState(transitionContract, common.BigToHash(big.NewInt(1))).Big(); have.Uint64() != gasLimit {
+		t.Errorf("gas limit mismatch: have %v, want %v", have, gasLimit)
+	}
+	if have := statedb.GetState(transitionContract, common.BigToHash(big.NewInt(2))).Big(); have.Uint64() != 5 {
+		t.Errorf("block number mismatch: have %v, want %v", have, 5)
+	}
+}
+
+// Tests that block context overrides only apply to the overridden message, and
+// later messages executed on the same EVM see the original block context.
+func TestBlockOverridesRestored(t *testing.T) {
+	// TIMESTAMP, PUSH1 0, SSTORE, GASLIMIT, PUSH1 1, SSTORE, NUMBER, PUSH1 2, SSTORE
+	code := []byte{
+		byte(vm.TIMESTAMP), byte(vm.PUSH1), 0, byte(vm.SSTORE),
+		byte(vm.GASLIMIT), byte(vm.PUSH1), 1, byte(vm.SSTORE),
+		byte(vm.NUMBER), byte(vm.PUSH1), 2, byte(vm.SSTORE),
+	}
+	statedb := newTransitionTestState()
+	statedb.SetCode(transitionContract, code)
+
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 5, statedb)
+	gasLimit := uint64(12345678)
+	overrides := &BlockOverrides{Number: big.NewInt(100), Time: big.NewInt(1700000000), GasLimit: &gasLimit}
+
+	// Simulate and apply a message with overrides, then apply one without
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 200000, big.NewInt(1), nil, true)
+	st := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas()))
+	st.SetBlockOverrides(overrides)
+	if _, err := st.Simulate(); err != nil {
+		t.Fatalf("simulation failed: %v", err)
+	}
+	st = NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas()))
+	st.SetBlockOverrides(overrides)
+	if _, _, failed, err := st.TransitionDb(); err != nil || failed {
+		t.Fatalf("overridden transition failed: failed %v, err %v", failed, err)
+	}
+	msg = types.NewMessage(transitionSender, &transitionContract, 1, big.NewInt(0), 200000, big.NewInt(1), nil, true)
+	if _, _, failed, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas())); err != nil || failed {
+		t.Fatalf("transition failed: failed %v, err %v", failed, err)
+	}
+	for slot, want := range []uint64{0, params.GenesisGasLimit, 5} {
+		if have := statedb.GetState(transitionContract, common.BigToHash(big.NewInt(int64(slot)))).Big(); have.Uint64() != want {
+			t.Errorf("slot %d mismatch: have %v, want %v", slot, have, want)
+		}
+	}
+	if evm.BlockNumber.Uint64() != 5 || evm.Time.Sign() != 0 || evm.GasLimit != params.GenesisGasLimit {
+		t.Errorf("block context not restored: number %v, time %v, gas limit %d", evm.BlockNumber, evm.Time, evm.GasLimit)
+	}
+}
+
+// Tests that a transition adding more state than the configured limit is
+// rejected and fully reverted, while transitions within the limit succeed.
+func TestStateGrowthLimit(t *testing.T) {
+	// Store non-zero values in three fresh slots, adding 3*64 bytes of state
+	code := []byte{
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE),
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 1, byte(vm.SSTORE),
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 2, byte(vm.SSTORE),
+	}
+	tests := []struct {
+		limit uint64
+		err   error
+	}{
+		{0, nil},
+		{192, nil},
+		{1000, nil},
+		{191, ErrStateGrowthLimitExceeded},
+		{64, ErrStateGrowthLimitExceeded},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, code)
+		balance := statedb.GetBalance(transitionSender)
+
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+		gp := new(GasPool).AddGas(params.GenesisGasLimit)
+
+		st := NewStateTransition(evm, msg, gp)
+		st.SetStateGrowthLimit(tt.limit)
+		if _, _, _, err := st.TransitionDb(); err != tt.err {
+			t.Fatalf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		stored := statedb.GetState(transitionContract, common.Hash{}) != (common.Hash{})
+		if tt.err == nil {
+			if !stored {
+				t.Errorf("test %d: storage not written", i)
+			}
+			continue
+		}
+		if stored {
+			t.Errorf("test %d: storage not reverted", i)
+		}
+		if nonce := statedb.GetNonce(transitionSender); nonce != 0 {
+			t.Errorf("test %d: nonce not reverted: have %d, want 0", i, nonce)
+		}
+		if have := statedb.GetBalance(transitionSender); have.Cmp(balance) != 0 {
+			t.Errorf("test %d: balance not reverted: have %v, want %v", i, have, balance)
+		}
+		if gp.Gas() != params.GenesisGasLimit {
+			t.Errorf("test %d: gas pool not restored: have %d, want %d", i, gp.Gas(), params.GenesisGasLimit)
+		}
+	}
+}
+
+// Tests that the refund counter delta reflects storage clearing regardless of
+// the cap applied to the credited refund.
+func TestRefundCounterDelta(t *testing.T) {
+	tests := []struct {
+		code  []byte
+		delta uint64
+		gas   uint64
+	}{
+		// PUSH1 0, PUSH1 0, SSTORE: clears the preset slot 0, refund capped at half
+		{[]byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.SSTORE)}, params.SstoreRefundGas, (params.TxGas + 5006) / 2},
+		// PUSH1 1, PUSH1 1, SSTORE: sets the empty slot 1
+		{[]byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 1, byte(vm.SSTORE)}, 0, params.TxGas + 20006},
+		// PUSH1 2, PUSH1 0, SSTORE: overwrites the preset slot 0
+		{[]byte{byte(vm.PUSH1), 2, byte(vm.PUSH1), 0, byte(vm.SSTORE)}, 0, params.TxGas + 5006},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, tt.code)
+		statedb.SetState(transitionContract, common.Hash{}, common.BytesToHash([]byte{1}))
+
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+
+		result, err := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas())).TransitionDb2()
+		if err != nil || result.Failed() {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		}
+		if result.RefundCounterDelta != tt.delta {
+			t.Errorf("test %d: refund counter delta mismatch: have %d, want %d", i, result.RefundCounterDelta, tt.delta)
+		}
+		if result.UsedGas != tt.gas {
+			t.Errorf("test %d: gas used mismatch: have %d, want %d", i, result.UsedGas, tt.gas)
+		}
+	}
+}
+
+// Tests that a self-mining sender, i.e. one that is also the coinbase, ends up
+// with its balance reduced by exactly the transferred value.
+func TestSenderIsCoinbase(t *testing.T) {
+	// BALANCE of the origin is stored in slot 0 during execution
+	code := []byte{byte(vm.ORIGIN), byte(vm.BALANCE), byte(vm.PUSH1), 0, byte(vm.SSTORE)}
+
+	statedb := newTransitionTestState()
+	statedb.SetCode(transitionContract, code)
+	initial := statedb.GetBalance(transitionSender)
+
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+	evm.Coinbase = transitionSender
+
+	var (
+		value    = big.NewInt(12345)
+		gasPrice = big.NewInt(10)
+		gasLimit = uint64(100000)
+	)
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, value, gasLimit, gasPrice, nil, true)
+	if _, gas, failed, err := NewStateTransition(evm, msg, new(GasPool).AddGas(gasLimit)).TransitionDb(); err != nil || failed {
+		t.Fatalf("transition failed: failed %v, err %v", failed, err)
+	} else if gas == 0 {
+		t.Fatalf("no gas used")
+	}
+	want := new(big.Int).Sub(initial, value)
+	if have := statedb.GetBalance(transitionSender); have.Cmp(want) != 0 {
+		t.Errorf("final balance mismatch: have %v, want %v", have, want)
+	}
+	// During execution the whole gas allowance and the value are debited
+	fee := new(big.Int).Mul(new(big.Int).SetUint64(gasLimit), gasPrice)
+	want = new(big.Int).Sub(want, fee)
+	if have := statedb.GetState(transitionContract, common.Hash{}).Big(); have.Cmp(want) != 0 {
+		t.Errorf("intermediate balance mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that the effective gas price matches the fee actually charged.
+func TestEffectiveGasPrice(t *testing.T) {
+	for i, price := range []int64{0, 1, 20000000000} {
+		statedb := newTransitionTestState()
+		initial := statedb.GetBalance(transitionSender)
+
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 50000, big.NewInt(price), nil, true)
+
+		result, err := ApplyMessageResult(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if err != nil {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		}
+		effective := result.EffectiveGasPrice
+		if effective.Cmp(big.NewInt(price)) != 0 {
+			t.Errorf("test %d: effective gas price mismatch: have %v, want %v", i, effective, price)
+		}
+		fee := new(big.Int).Sub(initial, statedb.GetBalance(transitionSender))
+		if want := new(big.Int).Mul(effective, new(big.Int).SetUint64(result.UsedGas)); fee.Cmp(want) != 0 {
+			t.Errorf("test %d: charged fee mismatch: have %v, want %v", i, fee, want)
+		}
+	}
+}
+
+// Tests that contract creations deploying code above the EIP-170 limit fail
+// with a dedicated error once the fork is active, and succeed at the limit.
+func TestMaxCodeSizeExceeded(t *testing.T) {
+	// PUSH2 size, PUSH1 0, RETURN: deploys size zero bytes
+	initcode := func(size int) []byte {
+		return []byte{byte(vm.PUSH2), byte(size >> 8), byte(size), byte(vm.PUSH1), 0, byte(vm.RETURN)}
+	}
+	preEIP158 := &params.ChainConfig{ChainID: big.NewInt(1), HomesteadBlock: big.NewInt(0)}
+
+	tests := []struct {
+		config *params.ChainConfig
+		size   int
+		err    error
+	}{
+		{params.AllEthashProtocolChanges, params.MaxCodeSize - 1, nil},
+		{params.AllEthashProtocolChanges, params.MaxCodeSize, nil},
+		{params.AllEthashProtocolChanges, params.MaxCodeSize + 1, vm.ErrMaxCodeSizeExceeded},
+		{preEIP158, params.MaxCodeSize + 1, nil},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		evm := newTransitionTestEVM(tt.config, 1, statedb)
+		msg := types.NewMessage(transitionSender, nil, 0, big.NewInt(0), 10000000, big.NewInt(1), initcode(tt.size), true)
+
+		res, err := ApplyMessageResult(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if err != nil {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		}
+		if res.Err != tt.err {
+			t.Errorf("test %d: vm error mismatch: have %v, want %v", i, res.Err, tt.err)
+		}
+		address := crypto.CreateAddress(transitionSender, 0)
+		if tt.err != nil {
+			if res.UsedGas != msg.Gas() {
+				t.Errorf("test %d: gas used mismatch: have %d, want %d", i, res.UsedGas, msg.Gas())
+			}
+			if size := statedb.GetCodeSize(address); size != 0 {
+				t.Errorf("test %d: code deployed: size %d", i, size)
+			}
+			continue
+		}
+		if size := statedb.GetCodeSize(address); size != tt.size {
+			t.Errorf("test %d: deployed code size mismatch: have %d, want %d", i, size, tt.size)
+		}
+	}
+}
+
+// Tests that the intermediate state root is verified when requested.
+func TestExpectedStateRoot(t *testing.T) {
+	// PUSH1 1, PUSH1 0, SSTORE
+	code := []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE)}
+
+	apply := func(root *common.Hash) (*state.StateDB, error) {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, code)
+
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+
+		st := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if root != nil {
+			st.SetExpectedRoot(*root)
+		}
+		_, _, _, err := st.TransitionDb()
+		return statedb, err
+	}
+	statedb, err := apply(nil)
+	if err != nil {
+		t.Fatalf("transition failed: %v", err)
+	}
+	root := statedb.IntermediateRoot(true)
+
+	if _, err := apply(&root); err != nil {
+		t.Errorf("matching root rejected: %v", err)
+	}
+	if _, err := apply(&common.Hash{0x01}); err != ErrStateRootMismatch {
+		t.Errorf("mismatching root error mismatch: have %v, want %v", err, ErrStateRootMismatch)
+	}
+}
+
+// Tests that the refund counter is clamped to the configured ceiling.
+func TestMaxRefund(t *testing.T) {
+	// Clear the three preset slots 0, 1 and 2, accruing 3 refunds
+	code := []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.SSTORE),
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 1, byte(vm.SSTORE),
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 2, byte(vm.SSTORE),
+	}
+	used := params.TxGas + 3*5006
+
+	tests := []struct {
+		max uint64
+		gas uint64
+	}{
+		{0, used - used/2},
+		{3 * params.SstoreRefundGas, used - used/2},
+		{10000, used - 10000},
+		{1, used - 1},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, code)
+		for slot := byte(0); slot < 3; slot++ {
+			statedb.SetState(transitionContract, common.BytesToHash([]byte{slot}), common.BytesToHash([]byte{1}))
+		}
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+
+		st := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		st.SetMaxRefund(tt.max)
+		result, err := st.TransitionDb2()
+		if err != nil || result.Failed() {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		}
+		if result.RefundCounterDelta != 3*params.SstoreRefundGas {
+			t.Errorf("test %d: refund counter mismatch: have %d, want %d", i, result.RefundCounterDelta, 3*params.SstoreRefundGas)
+		}
+		if result.UsedGas != tt.gas {
+			t.Errorf("test %d: gas used mismatch: have %d, want %d", i, result.UsedGas, tt.gas)
+		}
+	}
+}
+
+// callCode returns bytecode calling the given address without value and input,
+// discarding the result.
+func callCode(addr common.Address) []byte {
+	code := []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH20)}
+	code = append(code, addr.Bytes()...)
+	return append(code, byte(vm.GAS), byte(vm.CALL), byte(vm.POP))
+}
+
+// Tests that the storage slots modified by a transition are reported per
+// account, excluding writes of reverted calls.
+func TestModifiedStorage(t *testing.T) {
+	var (
+		callee   = common.HexToAddress("0x4000000000000000000000000000000000000004")
+		reverter = common.HexToAddress("0x5000000000000000000000000000000000000005")
+	)
+	code := []byte{
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE),
+		byte(vm.PUSH1), 2, byte(vm.PUSH1), 1, byte(vm.SSTORE),
+		byte(vm.PUSH1), 3, byte(vm.PUSH1), 1, byte(vm.SSTORE),
+	}
+	code = append(code, callCode(callee)...)
+	code = append(code, callCode(reverter)...)
+
+	statedb := newTransitionTestState()
+	statedb.SetCode(transitionContract, code)
+	statedb.SetCode(callee, []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 5, byte(vm.SSTORE)})
+	statedb.SetCode(reverter, []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 7, byte(vm.SSTORE), byte(vm.PUSH1), 0, byte(vm.DUP1), byte(vm.REVERT)})
+
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 200000, big.NewInt(1), nil, true)
+
+	st := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas()))
+	st.SetTrackStorage(true)
+	result, err := st.TransitionDb2()
+	if err != nil || result.Failed() {
+		t.Fatalf("transition failed: %v", err)
+	}
+	want := map[common.Address][]common.Hash{
+		transitionContract: {common.BytesToHash([]byte{0}), common.BytesToHash([]byte{1})},
+		callee:             {common.BytesToHash([]byte{5})},
+	}
+	if have := result.ModifiedStorage; !reflect.DeepEqual(have, want) {
+		t.Errorf("modified storage mismatch: have %x, want %x", have, want)
+	}
+}
+
+// Tests that exempt senders don't pay intrinsic gas while others do.
+func TestIntrinsicGasExemption(t *testing.T) {
+	exempt := common.HexToAddress("0x6000000000000000000000000000000000000006")
+	exemption := func(from common.Address) bool { return from == exempt }
+
+	tests := []struct {
+		from      common.Address
+		exemption func(common.Address) bool
+		gas       uint64
+	}{
+		{exempt, exemption, 0},
+		{transitionSender, exemption, params.TxGas + params.TxDataNonZeroGas},
+		{exempt, nil, params.TxGas + params.TxDataNonZeroGas},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.AddBalance(exempt, big.NewInt(params.Ether))
+
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(tt.from, &transitionContract, 0, big.NewInt(0), 50000, big.NewInt(1), []byte{1}, true)
+
+		st := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		st.SetIntrinsicGasExemption(tt.exemption)
+		if _, gas, _, err := st.TransitionDb(); err != nil {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		} else if gas != tt.gas {
+			t.Errorf("test %d: gas used mismatch: have %d, want %d", i, gas, tt.gas)
+		}
+	}
+}
+
+// cancelInterpreter cancels a context when running code prefixed with its magic
+// bytes and then calls into a loop, which runs until the EVM is cancelled or it
+// runs out of gas.
+type cancelInterpreter struct {
+	magic  []byte
+	evm    *vm.EVM
+	cancel context.CancelFunc
+	loop   common.Address
+}
+
+func (in *cancelInterpreter) Run(contract *vm.Contract, input []byte) ([]byte, error) {
+	in.cancel()
+	ret, _, err := in.evm.Call(contract, in.loop, nil, contract.Gas, new(big.Int))
+	return ret, err
+}
+
+func (in *cancelInterpreter) CanRun(code []byte) bool { return bytes.HasPrefix(code, in.magic) }
+func (in *cancelInterpreter) IsReadOnly() bool        { return false }
+func (in *cancelInterpreter) SetReadOnly(bool)        {}
+
+// Tests that transitions are aborted once their context is done, both before
+// and during execution.
+func TestTransitionDbContext(t *testing.T) {
+	var (
+		// JUMPDEST, PUSH1 0, JUMP: loops until running out of gas
+		code      = []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0, byte(vm.JUMP)}
+		canceller = common.HexToAddress("0xa00000000000000000000000000000000000000a")
+	)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		ctx     context.Context
+		to      common.Address
+		gas     uint64
+		err     error
+		charged bool
+	}{
+		{context.Background(), transitionContract, 100000, nil, true},
+		{cancelled, transitionContract, 100000, ErrExecutionCancelled, false},
+		{nil, canceller, 1000000, ErrExecutionCancelled, true},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, code)
+		statedb.SetCode(canceller, []byte{0xef, 0x01})
+		balance := statedb.GetBalance(transitionSender)
+
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+
+		// Cancel the context from within the execution if none is preset. The gas
+		// bounds the loop in case the cancellation is observed late.
+		ctx := tt.ctx
+		if ctx == nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithCancel(context.Background())
+			evm.AddInterpreter(&cancelInterpreter{magic: []byte{0xef, 0x01}, evm: evm, cancel: cancel, loop: transitionContract})
+		}
+		msg := types.NewMessage(transitionSender, &tt.to, 0, big.NewInt(0), tt.gas, big.NewInt(1), nil, true)
+
+		_, _, _, err := ApplyMessageContext(ctx, evm, msg, new(GasPool).AddGas(tt.gas))
+		if err != tt.err {
+			t.Fatalf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if charged := statedb.GetBalance(transitionSender).Cmp(balance) != 0; charged != tt.charged {
+			t.Errorf("test %d: sender charged mismatch: have %v, want %v", i, charged, tt.charged)
+		}
+	}
+}
+
+// Tests that a context done after the transition finished doesn't cancel the
+// EVM it ran on, as it is reused for subsequent messages.
+func TestTransitionDbContextFinished(t *testing.T) {
+	statedb := newTransitionTestState()
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+	if _, _, _, err := ApplyMessageContext(ctx, evm, msg, new(GasPool).AddGas(msg.Gas())); err != nil {
+		t.Fatalf("first transition failed: %v", err)
+	}
+	cancel()
+
+	// PUSH1 1, PUSH1 0, SSTORE: only stored if the EVM isn't cancelled
+	statedb.SetCode(transitionContract, []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE)})
+	msg = types.NewMessage(transitionSender, &transitionContract, 1, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+	if _, _, failed, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas())); err != nil || failed {
+		t.Fatalf("second transition failed: failed %v, err %v", failed, err)
+	}
+	if have := statedb.GetState(transitionContract, common.Hash{}); have != common.BytesToHash([]byte{1}) {
+		t.Errorf("storage mismatch: have %x, want %x", have, common.BytesToHash([]byte{1}))
+	}
+}
+
+// Tests that senders with code are rejected once EIP-3607 is active.
+func TestSenderNoEOA(t *testing.T) {
+	config := &params.ChainConfig{
+		ChainID:        big.NewInt(1),
+		HomesteadBlock: big.NewInt(0),
+		EIP3607Block:   big.NewInt(10),
+	}
+	tests := []struct {
+		number     uint64
+		code       []byte
+		checkNonce bool
+		err        error
+	}{
+		{9, nil, true, nil},
+		{9, []byte{byte(vm.STOP)}, true, nil},
+		{10, nil, true, nil},
+		{10, []byte{byte(vm.STOP)}, true, ErrSenderNoEOA},
+		{11, []byte{byte(vm.STOP)}, true, ErrSenderNoEOA},
+		{11, []byte{byte(vm.STOP)}, false, nil},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		if tt.code != nil {
+			statedb.SetCode(transitionSender, tt.code)
+		}
+		evm := newTransitionTestEVM(config, tt.number, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 50000, big.NewInt(1), nil, tt.checkNonce)
+
+		if _, _, _, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas())); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+// Tests that the logged fee breakdown matches the balance changes of the sender
+// and the coinbase.
+func TestLogFees(t *testing.T) {
+	var records []*log.Record
+
+	handler := log.Root().GetHandler()
+	defer log.Root().SetHandler(handler)
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		if r.Msg == "Transaction fees" {
+			records = append(records, r)
+		}
+		return nil
+	}))
+	// Clear the preset slot 0, accruing a refund
+	code := []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.SSTORE)}
+
+	for i, price := range []int64{0, 1, 3} {
+		records = records[:0]
+
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, code)
+		statedb.SetState(transitionContract, common.Hash{}, common.BytesToHash([]byte{1}))
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(5), 100000, big.NewInt(price), nil, true)
+
+		sender, coinbase := statedb.GetBalance(transitionSender), statedb.GetBalance(transitionCoinbase)
+
+		st := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		st.SetLogFees(true)
+		if _, _, failed, err := st.TransitionDb(); err != nil || failed {
+			t.Fatalf("test %d: transition failed: failed %v, err %v", i, failed, err)
+		}
+		if len(records) != 1 {
+			t.Fatalf("test %d: fee log count mismatch: have %d, want 1", i, len(records))
+		}
+		fields := make(map[string]*big.Int)
+		for j := 0; j < len(records[0].Ctx); j += 2 {
+			if amount, ok := records[0].Ctx[j+1].(*big.Int); ok {
+				fields[records[0].Ctx[j].(string)] = amount
+			}
+		}
+		debit, fee, refund := fields["debit"], fields["fee"], fields["refund"]
+		if debit == nil || fee == nil || refund == nil {
+			t.Fatalf("test %d: missing fee fields: %v", i, records[0].Ctx)
+		}
+		// The sender pays the debit minus the refund on top of the value
+		paid := new(big.Int).Sub(sender, statedb.GetBalance(transitionSender))
+		if want := new(big.Int).Add(new(big.Int).Sub(debit, refund), msg.Value()); paid.Cmp(want) != 0 {
+			t.Errorf("test %d: sender balance change mismatch: have %v, want %v", i, paid, want)
+		}
+		if earned := new(big.Int).Sub(statedb.GetBalance(transitionCoinbase), coinbase); earned.Cmp(fee) != 0 {
+			t.Errorf("test %d: coinbase balance change mismatch: have %v, want %v", i, earned, fee)
+		}
+		if price == 0 && (debit.Sign() != 0 || fee.Sign() != 0 || refund.Sign() != 0) {
+			t.Errorf("test %d: non-zero amounts for gas-free message: debit %v, fee %v, refund %v", i, debit, fee, refund)
+		}
+	}
+}
+
+// Tests that value transfers of nested calls failing for insufficient balance
+// are reported without failing the message.
+func TestFailedTransfers(t *testing.T) {
+	callee := common.HexToAddress("0x4000000000000000000000000000000000000004")
+
+	// Call the callee with a value of 1 wei, discarding the result
+	code := []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 1, byte(vm.PUSH20)}
+	code = append(code, callee.Bytes()...)
+	code = append(code, byte(vm.GAS), byte(vm.CALL), byte(vm.POP))
+
+	tests := []struct {
+		balance int64
+		failed  uint64
+	}{
+		{0, 1},
+		{1, 0},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, code)
+		statedb.AddBalance(transitionContract, big.NewInt(tt.balance))
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+
+		result, err := ApplyMessageResult(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if err != nil || result.Failed() {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		}
+		if result.FailedTransfers != tt.failed {
+			t.Errorf("test %d: failed transfers mismatch: have %d, want %d", i, result.FailedTransfers, tt.failed)
+		}
+		if have := statedb.GetBalance(callee).Int64(); have != tt.balance {
+			t.Errorf("test %d: callee balance mismatch: have %d, want %d", i, have, tt.balance)
+		}
+	}
+}
+
+// Tests that the execution result reports reverts, refunds and created contract
+// addresses.
+func TestExecutionResult(t *testing.T) {
+	statedb := newTransitionTestState()
+	statedb.SetCode(transitionContract, []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.SSTORE)})
+	statedb.SetState(transitionContract, common.Hash{}, common.BytesToHash([]byte{1}))
+	reverter := common.HexToAddress("0x4000000000000000000000000000000000000004")
+	statedb.SetCode(reverter, []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)})
+
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+
+	// Clearing a slot succeeds with a refund, capped to half the gas used
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+	result, err := ApplyMessageResult(evm, msg, new(GasPool).AddGas(msg.Gas()))
+	if err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	if used := params.TxGas + 5006; result.Failed() || result.RefundedGas != used/2 || result.UsedGas != used-used/2 {
+		t.Errorf("call result mismatch: failed %v, refunded %d, used %d", result.Failed(), result.RefundedGas, result.UsedGas)
+	}
+	// Reverting is a valid but failed execution
+	msg = types.NewMessage(transitionSender, &reverter, 1, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+	if result, err = ApplyMessageResult(evm, msg, new(GasPool).AddGas(msg.Gas())); err != nil {
+		t.Fatalf("revert failed: %v", err)
+	}
+	if result.Err == nil || !result.Failed() {
+		t.Errorf("revert not reported as failed")
+	}
+	// Creations report the address of the contract
+	msg = types.NewMessage(transitionSender, nil, 2, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+	if result, err = ApplyMessageResult(evm, msg, new(GasPool).AddGas(msg.Gas())); err != nil {
+		t.Fatalf("creation failed: %v", err)
+	}
+	if want := crypto.CreateAddress(transitionSender, 2); result.ContractAddress != want {
+		t.Errorf("contract address mismatch: have %x, want %x", result.ContractAddress, want)
+	}
+}
+
+// Tests that messages rejected by a state transition fail with classified errors.
+func TestTransitionErrorKinds(t *testing.T) {
+	tests := []struct {
+		nonce uint64
+		gas   uint64
+		price int64
+		kind  ErrorKind
+	}{
+		{3, 50000, 1, KindUnknown},
+		{3, params.TxGas - 1, 1, KindIntrinsicGasTooLow},
+		{3, 50000, params.Ether, KindInsufficientFunds},
+		{3, params.GenesisGasLimit + 1, 1, KindGasLimitReached},
+		{2, 50000, 1, KindNonceTooLow},
+		{4, 50000, 1, KindNonceTooHigh},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetNonce(transitionSender, 3)
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, tt.nonce, big.NewInt(0), tt.gas, big.NewInt(tt.price), nil, true)
+
+		_, _, _, err := ApplyMessage(evm, msg, new(GasPool).AddGas(params.GenesisGasLimit))
+		if kind := ErrorKindOf(err); kind != tt.kind {
+			t.Errorf("test %d: error kind mismatch: have %v, want %v (err %v)", i, kind, tt.kind, err)
+		}
+	}
+}
+
+// Tests that nonce errors report both the expected and the actual nonce, while
+// still matching the sentinel errors.
+func TestNonceError(t *testing.T) {
+	tests := []struct {
+		nonce    uint64
+		sentinel error
+		text     string
+	}{
+		{5, ErrNonceTooLow, "nonce too low: got 5, want 7"},
+		{9, ErrNonceTooHigh, "nonce too high: got 9, want 7"},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetNonce(transitionSender, 7)
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, tt.nonce, big.NewInt(0), 50000, big.NewInt(1), nil, true)
+
+		_, _, _, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		nerr, ok := err.(*NonceError)
+		if !ok {
+			t.Fatalf("test %d: error type mismatch: have %T, want *NonceError", i, err)
+		}
+		if nerr.Want != 7 || nerr.Got != tt.nonce {
+			t.Errorf("test %d: nonces mismatch: have %d/%d, want 7/%d", i, nerr.Want, nerr.Got, tt.nonce)
+		}
+		if err.Error() != tt.text {
+			t.Errorf("test %d: message mismatch: have %q, want %q", i, err.Error(), tt.text)
+		}
+		if nerr.Unwrap() != tt.sentinel {
+			t.Errorf("test %d: error %v doesn't wrap %v", i, err, tt.sentinel)
+		}
+	}
+}
+
+// Tests that intrinsic gas prices non-zero calldata bytes as per EIP-2028 from
+// Istanbul onwards.
+func TestIntrinsicGasEIP2028(t *testing.T) {
+	data := []byte{0, 1, 0, 2, 3}
+
+	tests := []struct {
+		data     []byte
+		creation bool
+		istanbul bool
+		gas      uint64
+	}{
+		{nil, false, false, params.TxGas},
+		{nil, false, true, params.TxGas},
+		{data, false, false, params.TxGas + 2*params.TxDataZeroGas + 3*params.TxDataNonZeroGas},
+		{data, false, true, params.TxGas + 2*params.TxDataZeroGas + 3*params.TxDataNonZeroGasEIP2028},
+		{data, true, false, params.TxGasContractCreation + 2*params.TxDataZeroGas + 3*params.TxDataNonZeroGas},
+		{data, true, true, params.TxGasContractCreation + 2*params.TxDataZeroGas + 3*params.TxDataNonZeroGasEIP2028},
+	}
+	for i, tt := range tests {
+		gas, err := intrinsicGas(tt.data, nil, tt.creation, params.DefaultIntrinsicGasSchedule(true, tt.istanbul))
+		if err != nil {
+			t.Fatalf("test %d: failed to compute intrinsic gas: %v", i, err)
+		}
+		if gas != tt.gas {
+			t.Errorf("test %d: intrinsic gas mismatch: have %d, want %d", i, gas, tt.gas)
+		}
+	}
+	// State transitions select the pricing by the fork of the block
+	config := &params.ChainConfig{
+		ChainID:        big.NewInt(1),
+		HomesteadBlock: big.NewInt(0),
+		IstanbulBlock:  big.NewInt(10),
+	}
+	for _, number := range []uint64{9, 10} {
+		statedb := newTransitionTestState()
+		evm := newTransitionTestEVM(config, number, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 50000, big.NewInt(1), data, true)
+
+		_, used, _, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if err != nil {
+			t.Fatalf("block %d: transition failed: %v", number, err)
+		}
+		want, _ := intrinsicGas(data, nil, false, params.DefaultIntrinsicGasSchedule(true, number >= 10))
+		if used != want {
+			t.Errorf("block %d: gas used mismatch: have %d, want %d", number, used, want)
+		}
+	}
+}
+
+// Tests that state transitions charge the intrinsic gas schedule of the chain.
+func TestIntrinsicGasCustomSchedule(t *testing.T) {
+	config := *params.AllEthashProtocolChanges
+	config.IntrinsicGas = &params.IntrinsicGasSchedule{TxGas: 5000, TxGasContractCreation: 7000, TxDataNonZeroGas: 100}
+
+	data := []byte{0, 1, 0, 2, 3}
+	tests := []struct {
+		to   *common.Address
+		want uint64
+	}{
+		{&transitionContract, 5000 + 2*params.TxDataZeroGas + 3*100},
+		{nil, 7000 + 2*params.TxDataZeroGas + 3*100},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		evm := newTransitionTestEVM(&config, 1, statedb)
+		msg := types.NewMessage(transitionSender, tt.to, 0, big.NewInt(0), 50000, big.NewInt(1), data, true)
+
+		// The message data doesn't run as code, so only intrinsic gas is used
+		_, used, _, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if err != nil {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		}
+		if used != tt.want {
+			t.Errorf("test %d: gas used mismatch: have %d, want %d", i, used, tt.want)
+		}
+	}
+	// Allowances covering the custom but not the mainnet price are accepted
+	statedb := newTransitionTestState()
+	evm := newTransitionTestEVM(&config, 1, statedb)
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 5000, big.NewInt(1), nil, true)
+
+	if _, _, _, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas())); err != nil {
+		t.Errorf("transition failed: %v", err)
+	}
+}
+
+// Tests that access lists are charged per address and storage key, and that
+// messages without one are charged as before.
+func TestIntrinsicGasAccessList(t *testing.T) {
+	list := types.AccessList{
+		{Address: transitionContract, StorageKeys: []common.Hash{{0x01}, {0x02}}},
+		{Address: transitionCoinbase, StorageKeys: []common.Hash{{0x03}}},
+	}
+	schedule := params.DefaultIntrinsicGasSchedule(true, false)
+
+	legacy, _ := intrinsicGas([]byte{1}, nil, false, schedule)
+	if empty, _ := intrinsicGas([]byte{1}, types.AccessList{}, false, schedule); empty != legacy {
+		t.Errorf("empty access list charged: have %d, want %d", empty, legacy)
+	}
+	gas, err := intrinsicGas([]byte{1}, list, false, schedule)
+	if err != nil {
+		t.Fatalf("failed to compute intrinsic gas: %v", err)
+	}
+	if want := legacy + 2*params.TxAccessListAddressGas + 3*params.TxAccessListStorageKeyGas; gas != want {
+		t.Errorf("intrinsic gas mismatch: have %d, want %d", gas, want)
+	}
+	// State transitions charge the access list of the message
+	statedb := newTransitionTestState()
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+	msg := types.NewMessageWithAccessList(transitionSender, &transitionContract, 0, big.NewInt(0), 50000, big.NewInt(1), []byte{1}, list, true)
+
+	if _, used, _, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas())); err != nil || used != gas {
+		t.Errorf("gas used mismatch: have %d, want %d (err %v)", used, gas, err)
+	}
+}
+
+// Tests that the exported intrinsic gas keeps pricing messages like before fork
+// dependent and configurable schedules, ignoring Istanbul.
+func TestIntrinsicGasLegacy(t *testing.T) {
+	tests := []struct {
+		data      []byte
+		creation  bool
+		homestead bool
+		want      uint64
+	}{
+		{nil, false, false, params.TxGas},
+		{nil, true, false, params.TxGas},
+		{nil, true, true, params.TxGasContractCreation},
+		{[]byte{0, 1}, false, true, params.TxGas + params.TxDataZeroGas + params.TxDataNonZeroGas},
+	}
+	for i, tt := range tests {
+		if gas, err := IntrinsicGas(tt.data, tt.creation, tt.homestead); err != nil || gas != tt.want {
+			t.Errorf("test %d: intrinsic gas mismatch: have %d (err %v), want %d", i, gas, err, tt.want)
+		}
+	}
+}
+
+// Tests that computing the intrinsic gas doesn't allocate.
+func TestIntrinsicGasNoAlloc(t *testing.T) {
+	var (
+		data   = bytes.Repeat([]byte{0x00, 0x01}, 512)
+		list   = types.AccessList{{Address: transitionContract, StorageKeys: []common.Hash{{0x01}}}}
+		number = big.NewInt(1)
+	)
+	// Resolve the prices per run like state transitions do
+	allocs := testing.AllocsPerRun(100, func() {
+		intrinsicGas(data, list, true, params.AllEthashProtocolChanges.IntrinsicGasSchedule(number))
+	})
+	if allocs != 0 {
+		t.Errorf("intrinsic gas allocated %v times", allocs)
+	}
+}
+
+// Benchmarks computing the intrinsic gas of a message with a kilobyte of data.
+func BenchmarkIntrinsicGas(b *testing.B) {
+	var (
+		data   = bytes.Repeat([]byte{0x00, 0x01}, 512)
+		number = big.NewInt(1)
+	)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := intrinsicGas(data, nil, false, params.AllEthashProtocolChanges.IntrinsicGasSchedule(number)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Tests that simulating a message reports its outcome without any side effects.
+func TestSimulate(t *testing.T) {
+	// Clear the preset slot 0, accruing a refund, and return 32 bytes
+	code := []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.SSTORE),
+		byte(vm.PUSH1), 32, byte(vm.PUSH1), 0, byte(vm.RETURN),
+	}
+	statedb := newTransitionTestState()
+	statedb.SetCode(transitionContract, code)
+	statedb.SetState(transitionContract, common.Hash{}, common.BytesToHash([]byte{1}))
+	root := statedb.IntermediateRoot(false)
+
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(5), 100000, big.NewInt(1), nil, true)
+	gp := new(GasPool).AddGas(msg.Gas())
+
+	result, err := NewStateTransition(evm, msg, gp).Simulate()
+	if err != nil {
+		t.Fatalf("simulation failed: %v", err)
+	}
+	if statedb.IntermediateRoot(false) != root {
+		t.Errorf("simulation modified the state")
+	}
+	if nonce := statedb.GetNonce(transitionSender); nonce != 0 {
+		t.Errorf("sender nonce modified: have %d, want 0", nonce)
+	}
+	if gp.Gas() != msg.Gas() {
+		t.Errorf("gas pool modified: have %d, want %d", gp.Gas(), msg.Gas())
+	}
+	// The simulation must match actually applying the message
+	ret, used, failed, err := ApplyMessage(evm, msg, gp)
+	if err != nil {
+		t.Fatalf("transition failed: %v", err)
+	}
+	if !bytes.Equal(result.ReturnData, ret) || result.UsedGas != used || result.Failed() != failed {
+		t.Errorf("simulation mismatch: have (%x, %d, %v), want (%x, %d, %v)", result.ReturnData, result.UsedGas, result.Failed(), ret, used, failed)
+	}
+}
+
+// Tests that messages without a gas price leave the balances of the sender and
+// the coinbase unchanged, but still consume gas from the gas pool.
+func TestFreeGas(t *testing.T) {
+	statedb := newTransitionTestState()
+	statedb.SetCode(transitionContract, []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE)})
+	balance := statedb.GetBalance(transitionSender)
+
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(0), nil, true)
+	gp := new(GasPool).AddGas(params.GenesisGasLimit)
+
+	_, used, failed, err := ApplyMessage(evm, msg, gp)
+	if err != nil || failed {
+		t.Fatalf("transition failed: failed %v, err %v", failed, err)
+	}
+	if want := params.TxGas + 20006; used != want {
+		t.Errorf("gas used mismatch: have %d, want %d", used, want)
+	}
+	if gp.Gas() != params.GenesisGasLimit-used {
+		t.Errorf("gas pool mismatch: have %d, want %d", gp.Gas(), params.GenesisGasLimit-used)
+	}
+	if statedb.GetBalance(transitionSender).Cmp(balance) != 0 {
+		t.Errorf("sender balance changed: have %v, want %v", statedb.GetBalance(transitionSender), balance)
+	}
+	statedb.Finalise(true)
+	if statedb.Exist(transitionCoinbase) {
+		t.Errorf("coinbase account created")
+	}
+}
+
+// Tests that messages without a gas price still touch an existing empty
+// coinbase, so that it is deleted like for priced messages.
+func TestFreeGasEmptyCoinbase(t *testing.T) {
+	statedb := newTransitionTestState()
+	statedb.CreateAccount(transitionCoinbase)
+	statedb.Finalise(false)
+
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(0), nil, true)
+	if _, _, failed, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas())); err != nil || failed {
+		t.Fatalf("transition failed: failed %v, err %v", failed, err)
+	}
+	statedb.Finalise(true)
+	if statedb.Exist(transitionCoinbase) {
+		t.Errorf("empty coinbase not deleted")
+	}
+}
+
+// Tests that state transitions update the transition metrics.
+func TestTransitionMetrics(t *testing.T) {
+	enabled := metrics.Enabled
+	counter, histogram, timer := transitionPublicCounter, transitionGasHistogram, transitionExecutionTimer
+	defer func() {
+		metrics.Enabled = enabled
+		transitionPublicCounter, transitionGasHistogram, transitionExecutionTimer = counter, histogram, timer
+	}()
+	metrics.Enabled = true
+	transitionPublicCounter = metrics.NewCounter()
+	transitionGasHistogram = metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	transitionExecutionTimer = metrics.NewTimer()
+
+	statedb := newTransitionTestState()
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+
+	var total int64
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		msg := types.NewMessage(transitionSender, &transitionContract, nonce, big.NewInt(0), 50000, big.NewInt(1), make([]byte, nonce), true)
+		_, used, _, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if err != nil {
+			t.Fatalf("transition %d failed: %v", nonce, err)
+		}
+		total += int64(used)
+	}
+	// Rejected messages are not counted
+	msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 50000, big.NewInt(1), nil, true)
+	if _, _, _, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas())); err == nil {
+		t.Fatalf("stale nonce accepted")
+	}
+	if count := transitionPublicCounter.Count(); count != 3 {
+		t.Errorf("transition count mismatch: have %d, want 3", count)
+	}
+	if count, sum := transitionGasHistogram.Count(), transitionGasHistogram.Sum(); count != 3 || sum != total {
+		t.Errorf("gas histogram mismatch: have %d samples summing to %d, want 3 summing to %d", count, sum, total)
+	}
+	if count := transitionExecutionTimer.Count(); count != 3 {
+		t.Errorf("execution timer count mismatch: have %d, want 3", count)
+	}
+}
+
+// Benchmarks applying a plain value transfer, the hot path of block import.
+func BenchmarkApplyMessage(b *testing.B) {
+	statedb := newTransitionTestState()
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := types.NewMessage(transitionSender, &transitionContract, uint64(i), big.NewInt(1), params.TxGas, big.NewInt(1), nil, true)
+		if _, _, _, err := ApplyMessage(evm, msg, new(GasPool).AddGas(msg.Gas())); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Tests that messages built by types.NewMessage implement Message and return
+// what they were built with.
+func TestNewMessageAccessors(t *testing.T) {
+	var (
+		to   = transitionContract
+		list = types.AccessList{{Address: transitionCoinbase, StorageKeys: []common.Hash{{0x01}}}}
+	)
+	var msg Message = types.NewMessageWithAccessList(transitionSender, &to, 7, big.NewInt(5), 50000, big.NewInt(3), []byte{0xca, 0xfe}, list, true)
+
+	if msg.From() != transitionSender {
+		t.Errorf("sender mismatch: have %x, want %x", msg.From(), transitionSender)
+	}
+	if msg.To() == nil || *msg.To() != to {
+		t.Errorf("recipient mismatch: have %v, want %x", msg.To(), to)
+	}
+	if msg.Nonce() != 7 || msg.Gas() != 50000 || !msg.CheckNonce() {
+		t.Errorf("field mismatch: nonce %d, gas %d, check nonce %v", msg.Nonce(), msg.Gas(), msg.CheckNonce())
+	}
+	if msg.Value().Cmp(big.NewInt(5)) != 0 || msg.GasPrice().Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("amount mismatch: value %v, gas price %v", msg.Value(), msg.GasPrice())
+	}
+	if !bytes.Equal(msg.Data(), []byte{0xca, 0xfe}) {
+		t.Errorf("data mismatch: have %x", msg.Data())
+	}
+	if !reflect.DeepEqual(msg.AccessList(), list) {
+		t.Errorf("access list mismatch: have %v, want %v", msg.AccessList(), list)
+	}
+	// Contract creations have no recipient
+	if msg = types.NewMessage(transitionSender, nil, 0, big.NewInt(0), 0, big.NewInt(0), nil, false); msg.To() != nil || msg.CheckNonce() {
+		t.Errorf("creation mismatch: recipient %v, check nonce %v", msg.To(), msg.CheckNonce())
+	}
+}
+
+// Tests that messages rejected after buying gas return it to the gas pool.
+func TestRejectedMessageGasPool(t *testing.T) {
+	tests := []struct {
+		gas   uint64
+		value *big.Int
+		err   error
+	}{
+		// Intrinsic gas not covered by the allowance
+		{params.TxGas - 1, big.NewInt(0), ErrIntrinsicGas},
+		// Value not covered by the balance left after buying gas
+		{params.TxGas, new(big.Int).Mul(big.NewInt(1000), big.NewInt(params.Ether)), vm.ErrInsufficientBalance},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, tt.value, tt.gas, big.NewInt(1), nil, true)
+		gp := new(GasPool).AddGas(params.GenesisGasLimit)
+
+		if _, _, _, err := ApplyMessage(evm, msg, gp); err != tt.err {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if gp.Gas() != params.GenesisGasLimit {
+			t.Errorf("test %d: gas pool not restored: have %d, want %d", i, gp.Gas(), params.GenesisGasLimit)
+		}
+	}
+}
+
+// Tests that refunds are capped to a fifth of the used gas from London onwards,
+// and that suicides no longer accrue refunds.
+func TestRefundQuotientEIP3529(t *testing.T) {
+	config := &params.ChainConfig{
+		ChainID:        big.NewInt(1),
+		HomesteadBlock: big.NewInt(0),
+		EIP150Block:    big.NewInt(0),
+		EIP158Block:    big.NewInt(0),
+		ByzantiumBlock: big.NewInt(0),
+		LondonBlock:    big.NewInt(10),
+	}
+	// Clear the three preset slots 0, 1 and 2, accruing 3 refunds
+	clear := []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.SSTORE),
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 1, byte(vm.SSTORE),
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 2, byte(vm.SSTORE),
+	}
+	cleared := params.TxGas + 3*5006
+
+	// Non-zero calldata inflating the gas used above five times the refunds
+	data := bytes.Repeat([]byte{1}, 3000)
+	inflated := cleared + 3000*params.TxDataNonZeroGas
+
+	tests := []struct {
+		number uint64
+		data   []byte
+		used   uint64
+		refund uint64
+	}{
+		{9, nil, cleared, cleared / 2},
+		{10, nil, cleared, cleared / 5},
+		{9, data, inflated, 3 * params.SstoreRefundGas},
+		{10, data, inflated, 3 * params.SstoreRefundGas},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, clear)
+		for slot := byte(0); slot < 3; slot++ {
+			statedb.SetState(transitionContract, common.BytesToHash([]byte{slot}), common.BytesToHash([]byte{1}))
+		}
+		evm := newTransitionTestEVM(config, tt.number, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 500000, big.NewInt(1), tt.data, true)
+
+		result, err := ApplyMessageResult(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if err != nil || result.Failed() {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		}
+		if result.RefundedGas != tt.refund || result.UsedGas != tt.used-tt.refund {
+			t.Errorf("test %d: refund mismatch: have %d refunded, %d used, want %d refunded, %d used", i, result.RefundedGas, result.UsedGas, tt.refund, tt.used-tt.refund)
+		}
+	}
+	// Suicides accrue refunds before London only
+	for _, tt := range []struct {
+		number uint64
+		refund uint64
+	}{{9, params.SuicideRefundGas}, {10, 0}} {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, []byte{byte(vm.PUSH1), 0, byte(vm.SELFDESTRUCT)})
+		evm := newTransitionTestEVM(config, tt.number, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+
+		result, err := ApplyMessageResult(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if err != nil || result.Failed() {
+			t.Fatalf("block %d: suicide failed: %v", tt.number, err)
+		}
+		if result.RefundCounterDelta != tt.refund {
+			t.Errorf("block %d: suicide refund mismatch: have %d, want %d", tt.number, result.RefundCounterDelta, tt.refund)
+		}
+	}
+}
+
+// Tests that the data of reverted executions is reported as revert reason and
+// can be decoded, while other failures report none.
+func TestExecutionResultRevert(t *testing.T) {
+	reason := common.Hex2Bytes("08c379a00000000000000000000000000000000000000000000000000000000000000020000000000000000000000000000000000000000000000000000000000000000d72657665727420726561736f6e00000000000000000000000000000000000000")
+
+	// Copy the reason following the code into memory and revert with it
+	reverter := []byte{
+		byte(vm.PUSH1), byte(len(reason)), byte(vm.PUSH1), 12, byte(vm.PUSH1), 0, byte(vm.CODECOPY),
+		byte(vm.PUSH1), byte(len(reason)), byte(vm.PUSH1), 0, byte(vm.REVERT),
+	}
+	reverter = append(reverter, reason...)
+
+	tests := []struct {
+		code   []byte
+		reason string
+	}{
+		{reverter, "revert reason"},
+		{[]byte{0xfe}, ""}, // invalid opcode
+		{[]byte{byte(vm.STOP)}, ""},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		statedb.SetCode(transitionContract, tt.code)
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(1), nil, true)
+
+		result, err := ApplyMessageResult(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if err != nil {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		}
+		if tt.reason == "" {
+			if result.Revert() != nil {
+				t.Errorf("test %d: unexpected revert data: %x", i, result.Revert())
+			}
+			continue
+		}
+		if !bytes.Equal(result.Revert(), reason) {
+			t.Errorf("test %d: revert data mismatch: have %x, want %x", i, result.Revert(), reason)
+		}
+		if have, err := abi.UnpackRevert(result.Revert()); err != nil || have != tt.reason {
+			t.Errorf("test %d: revert reason mismatch: have %q, want %q (err %v)", i, have, tt.reason, err)
+		}
+	}
+}
+
+// Tests that fees are credited to the configured recipient or distributed by
+// the fee hook, while refunds still go to the sender.
+func TestFeeRecipient(t *testing.T) {
+	treasury := common.HexToAddress("0x4000000000000000000000000000000000000004")
+
+	tests := []struct {
+		price     int64
+		recipient bool
+		hook      bool
+	}{
+		{1, false, false},
+		{3, true, false},
+		{3, true, true},
+		{0, true, false},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		balance := statedb.GetBalance(transitionSender)
+
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 50000, big.NewInt(tt.price), nil, true)
+
+		st := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if tt.recipient {
+			st.SetFeeRecipient(treasury)
+		}
+		var hooked *big.Int
+		if tt.hook {
+			st.SetFeeHook(func(statedb vm.StateDB, fee *big.Int) { hooked = fee })
+		}
+		_, used, _, err := st.TransitionDb()
+		if err != nil {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		}
+		fee := new(big.Int).Mul(new(big.Int).SetUint64(used), big.NewInt(tt.price))
+
+		if paid := new(big.Int).Sub(balance, statedb.GetBalance(transitionSender)); paid.Cmp(fee) != 0 {
+			t.Errorf("test %d: sender paid %v, want %v", i, paid, fee)
+		}
+		want := map[common.Address]*big.Int{transitionCoinbase: new(big.Int), treasury: new(big.Int)}
+		switch {
+		case tt.hook:
+			if hooked == nil || hooked.Cmp(fee) != 0 {
+				t.Errorf("test %d: hook fee mismatch: have %v, want %v", i, hooked, fee)
+			}
+		case tt.recipient:
+			want[treasury] = fee
+		default:
+			want[transitionCoinbase] = fee
+		}
+		for addr, amount := range want {
+			if have := statedb.GetBalance(addr); have.Cmp(amount) != 0 {
+				t.Errorf("test %d: balance of %x mismatch: have %v, want %v", i, addr, have, amount)
+			}
+		}
+	}
+}
+
+// sponsoredMessage is a message with its gas paid for by a separate account.
+type sponsoredMessage struct {
+	types.Message
+	payer *common.Address
+}
+
+func (m sponsoredMessage) GasPayer() *common.Address { return m.payer }
+
+// Tests that the gas of sponsored messages is bought from and refunded to the
+// gas payer, while the sender pays the value and has its nonce advanced.
+func TestGasPayer(t *testing.T) {
+	var (
+		sponsor = common.HexToAddress("0x5000000000000000000000000000000000000005")
+		funds   = new(big.Int).Mul(big.NewInt(10), big.NewInt(params.Ether))
+		price   = big.NewInt(2)
+		value   = big.NewInt(7)
+	)
+	tests := []struct {
+		payer  *common.Address
+		funded bool
+		err    error
+	}{
+		{nil, false, nil},
+		{&sponsor, true, nil},
+		{&sponsor, false, ErrInsufficientBalanceForGas},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		if tt.funded {
+			statedb.AddBalance(sponsor, funds)
+		}
+		var (
+			senderBalance  = new(big.Int).Set(statedb.GetBalance(transitionSender))
+			sponsorBalance = new(big.Int).Set(statedb.GetBalance(sponsor))
+		)
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := sponsoredMessage{
+			Message: types.NewMessage(transitionSender, &transitionContract, 0, value, 100000, price, nil, true),
+			payer:   tt.payer,
+		}
+		_, used, _, err := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas())).TransitionDb()
+		if tt.err != nil {
+			// Shortfalls must be attributed to the sponsor
+			perr, ok := err.(*GasPayerError)
+			if !ok || perr.Unwrap() != tt.err || perr.Payer != sponsor {
+				t.Fatalf("test %d: error mismatch: have %v, want %v of %x", i, err, tt.err, sponsor)
+			}
+		} else if err != nil {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		}
+		if err != nil {
+			if nonce := statedb.GetNonce(transitionSender); nonce != 0 {
+				t.Errorf("test %d: nonce advanced to %d on failure", i, nonce)
+			}
+			if have := statedb.GetBalance(transitionSender); have.Cmp(senderBalance) != 0 {
+				t.Errorf("test %d: sender balance changed on failure: have %v, want %v", i, have, senderBalance)
+			}
+			continue
+		}
+		if nonce := statedb.GetNonce(transitionSender); nonce != 1 {
+			t.Errorf("test %d: sender nonce mismatch: have %d, want 1", i, nonce)
+		}
+		// The unused gas must be refunded to whoever bought it
+		fee := new(big.Int).Mul(new(big.Int).SetUint64(used), price)
+		senderPaid, sponsorPaid := new(big.Int).Set(value), new(big.Int)
+		if tt.payer == nil {
+			senderPaid.Add(senderPaid, fee)
+		} else {
+			sponsorPaid.Set(fee)
+		}
+		if paid := new(big.Int).Sub(senderBalance, statedb.GetBalance(transitionSender)); paid.Cmp(senderPaid) != 0 {
+			t.Errorf("test %d: sender paid %v, want %v", i, paid, senderPaid)
+		}
+		if paid := new(big.Int).Sub(sponsorBalance, statedb.GetBalance(sponsor)); paid.Cmp(sponsorPaid) != 0 {
+			t.Errorf("test %d: gas payer paid %v, want %v", i, paid, sponsorPaid)
+		}
+		if have := statedb.GetBalance(transitionCoinbase); have.Cmp(fee) != 0 {
+			t.Errorf("test %d: coinbase balance mismatch: have %v, want %v", i, have, fee)
+		}
+	}
+}
+
+// Tests that the unused gas of sponsored messages, including the refund counter
+// share, is refunded to the gas payer and always returned to the gas pool.
+func TestGasPayerRefund(t *testing.T) {
+	// Clear the preset slot 0, accruing a refund
+	code := []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.SSTORE)}
+	sponsor := common.HexToAddress("0x5000000000000000000000000000000000000005")
+
+	for _, price := range []int64{0, 3} {
+		statedb := newTransitionTestState()
+		statedb.AddBalance(sponsor, big.NewInt(params.Ether))
+		statedb.SetCode(transitionContract, code)
+		statedb.SetState(transitionContract, common.Hash{}, common.BytesToHash([]byte{1}))
+
+		var (
+			senderBalance  = new(big.Int).Set(statedb.GetBalance(transitionSender))
+			sponsorBalance = new(big.Int).Set(statedb.GetBalance(sponsor))
+		)
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := sponsoredMessage{
+			Message: types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 100000, big.NewInt(price), nil, true),
+			payer:   &sponsor,
+		}
+		gp := new(GasPool).AddGas(params.GenesisGasLimit)
+
+		result, err := ApplyMessageResult(evm, msg, gp)
+		if err != nil {
+			t.Fatalf("price %d: transition failed: %v", price, err)
+		}
+		if result.RefundedGas == 0 {
+			t.Fatalf("price %d: no gas refunded", price)
+		}
+		fee := new(big.Int).Mul(new(big.Int).SetUint64(result.UsedGas), big.NewInt(price))
+		if paid := new(big.Int).Sub(sponsorBalance, statedb.GetBalance(sponsor)); paid.Cmp(fee) != 0 {
+			t.Errorf("price %d: gas payer paid %v, want %v", price, paid, fee)
+		}
+		if have := statedb.GetBalance(transitionSender); have.Cmp(senderBalance) != 0 {
+			t.Errorf("price %d: sender balance changed: have %v, want %v", price, have, senderBalance)
+		}
+		if gp.Gas() != params.GenesisGasLimit-result.UsedGas {
+			t.Errorf("price %d: gas pool mismatch: have %d, want %d", price, gp.Gas(), params.GenesisGasLimit-result.UsedGas)
+		}
+	}
+}
+
+// Tests that messages rejected on their nonce or gas balance leave no empty
+// sender or recipient accounts behind in the state.
+func TestRejectedMessageNoAccounts(t *testing.T) {
+	var (
+		poor      = common.HexToAddress("0x6000000000000000000000000000000000000006")
+		recipient = common.HexToAddress("0x7000000000000000000000000000000000000007")
+	)
+	tests := []struct {
+		from  common.Address
+		to    *common.Address
+		nonce uint64
+		err   error
+	}{
+		{transitionSender, &recipient, 5, ErrNonceTooHigh},
+		{poor, &recipient, 0, ErrInsufficientBalanceForGas},
+		{poor, nil, 0, ErrInsufficientBalanceForGas},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(tt.from, tt.to, tt.nonce, big.NewInt(1), 50000, big.NewInt(1), nil, true)
+
+		_, _, _, err := NewStateTransition(evm, msg, new(GasPool).AddGas(msg.Gas())).TransitionDb()
+		if ErrorKindOf(err) != ErrorKindOf(tt.err) {
+			t.Fatalf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if tt.err == ErrInsufficientBalanceForGas {
+			if perr, ok := err.(*GasPayerError); !ok || perr.Payer != tt.from {
+				t.Errorf("test %d: error not attributed to %x: %v", i, tt.from, err)
+			}
+		}
+		for _, addr := range []common.Address{poor, recipient, crypto.CreateAddress(tt.from, 0)} {
+			if statedb.Exist(addr) {
+				t.Errorf("test %d: account %x created by rejected message", i, addr)
+			}
+		}
+	}
+}
+
+// stubInterpreter runs code prefixed with its magic bytes, returning the input.
+type stubInterpreter struct {
+	magic []byte
+	runs  int
+}
+
+func (in *stubInterpreter) Run(contract *vm.Contract, input []byte) ([]byte, error) {
+	in.runs++
+	return append([]byte("stub"), input...), nil
+}
+
+func (in *stubInterpreter) CanRun(code []byte) bool { return bytes.HasPrefix(code, in.magic) }
+func (in *stubInterpreter) IsReadOnly() bool        { return false }
+func (in *stubInterpreter) SetReadOnly(bool)        {}
+
+// Tests that code carrying the magic bytes of a custom interpreter is routed to
+// it, that other code still runs on the default interpreter and that the result
+// reports which one ran.
+func TestCustomInterpreter(t *testing.T) {
+	var (
+		stub  = &stubInterpreter{magic: []byte{0xef, 0x00}}
+		wasm  = common.HexToAddress("0x8000000000000000000000000000000000000008")
+		plain = common.HexToAddress("0x9000000000000000000000000000000000000009")
+		input = []byte{0x01, 0x02}
+	)
+	statedb := newTransitionTestState()
+	statedb.SetCode(wasm, []byte{0xef, 0x00, 0xaa})
+	statedb.SetCode(plain, []byte{0x60, 0x00}) // PUSH1 0
+
+	evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+	evm.AddInterpreter(stub)
+
+	tests := []struct {
+		to     *common.Address
+		data   []byte
+		stub   bool
+		output []byte
+	}{
+		{&wasm, input, true, []byte("stub\x01\x02")},
+		{&plain, input, false, nil},
+		{nil, []byte{0xef, 0x00}, true, []byte("stub")},
+		{nil, []byte{0x60, 0x00}, false, nil},
+	}
+	for i, tt := range tests {
+		msg := types.NewMessage(transitionSender, tt.to, uint64(i), big.NewInt(0), 100000, big.NewInt(1), tt.data, true)
+		result, err := ApplyMessageResult(evm, msg, new(GasPool).AddGas(msg.Gas()))
+		if err != nil {
+			t.Fatalf("test %d: transition failed: %v", i, err)
+		}
+		if result.Failed() {
+			t.Fatalf("test %d: execution failed: %v", i, result.Err)
+		}
+		want := evm.Interpreter()
+		if tt.stub {
+			want = stub
+		}
+		if result.Interpreter != want {
+			t.Errorf("test %d: interpreter mismatch: have %T, want %T", i, result.Interpreter, want)
+		}
+		if !bytes.Equal(result.ReturnData, tt.output) {
+			t.Errorf("test %d: return data mismatch: have %x, want %x", i, result.ReturnData, tt.output)
+		}
+	}
+	if stub.runs != 2 {
+		t.Errorf("stub interpreter ran %d times, want 2", stub.runs)
+	}
+	if evm.Interpreter() == vm.Interpreter(stub) {
+		t.Errorf("default interpreter not restored")
+	}
+}
+
+// Tests that messages carrying more data than allowed are rejected before
+// buying gas, and that the limit is disabled by default.
+func TestMaxCalldataSize(t *testing.T) {
+	tests := []struct {
+		size  int
+		limit uint64 // zero keeps the default
+		err   error
+	}{
+		{1024, 0, nil},
+		{int(params.MaxCalldataSize) + 1, 0, ErrIntrinsicGas},
+		{int(params.MaxCalldataSize) + 1, params.MaxCalldataSize, ErrCalldataTooLarge},
+		{100, 100, nil},
+		{101, 100, ErrCalldataTooLarge},
+	}
+	for i, tt := range tests {
+		statedb := newTransitionTestState()
+		balance := new(big.Int).Set(statedb.GetBalance(transitionSender))
+
+		evm := newTransitionTestEVM(params.AllEthashProtocolChanges, 1, statedb)
+		msg := types.NewMessage(transitionSender, &transitionContract, 0, big.NewInt(0), 50000, big.NewInt(1), make([]byte, tt.size), true)
+		gp := new(GasPool).AddGas(msg.Gas())
+
+		st := NewStateTransition(evm, msg, gp)
+		if tt.limit > 0 {
+			st.SetMaxCalldataSize(tt.limit)
+		}
+		if _, _, _, err := st.TransitionDb(); err != tt.err {
+			t.Fatalf("test %d: error mismatch: have %v, want %v", i, err, tt.err)
+		}
+		if tt.err != ErrCalldataTooLarge {
+			continue
+		}
+		if nonce := statedb.GetNonce(transitionSender); nonce != 0 {
+			t.Errorf("test %d: nonce advanced to %d", i, nonce)
+		}
+		if have := statedb.GetBalance(transitionSender); have.Cmp(balance) != 0 {
+			t.Errorf("test %d: balance changed: have %v, want %v", i, have, balance)
+		}
+		if gp.Gas() != msg.Gas() {
+			t.Errorf("test %d: gas pool mismatch: have %d, want %d", i, gp.Gas(), msg.Gas())
+		}
+		// Simulations are subject to the limit too
+		st = NewStateTransition(evm, msg, gp)
+		if tt.limit > 0 {
+			st.SetMaxCalldataSize(tt.limit)
+		}
+		if _, err := st.Simulate(); err != tt.err {
+			t.Errorf("test %d: simulation error mismatch: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
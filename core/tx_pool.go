@@ -46,7 +46,7 @@ var (
 
 	// ErrNonceTooLow is returned if the nonce of a transaction is lower than the
 	// one present in the local chain.
-	ErrNonceTooLow = errors.New("nonce too low")
+	ErrNonceTooLow = newCoreError(KindNonceTooLow, "nonce too low")
 
 	// ErrUnderpriced is returned if a transaction's gas price is below the minimum
 	// configured for the transaction pool.
@@ -58,11 +58,11 @@ var (
 
 	// ErrInsufficientFunds is returned if the total cost of executing a transaction
 	// is higher than the balance of the user's account.
-	ErrInsufficientFunds = errors.New("insufficient funds for gas * price + value")
+	ErrInsufficientFunds = newCoreError(KindInsufficientFunds, "insufficient funds for gas * price + value")
 
 	// ErrIntrinsicGas is returned if the transaction is specified to use less gas
 	// than required to start the invocation.
-	ErrIntrinsicGas = errors.New("intrinsic gas too low")
+	ErrIntrinsicGas = newCoreError(KindIntrinsicGasTooLow, "intrinsic gas too low")
 
 	// ErrGasLimit is returned if a transaction's requested gas limit exceeds the
 	// maximum allowance of the current block.
@@ -209,7 +209,7 @@ type TxPool struct {
 
 	wg sync.WaitGroup // for shutdown sync
 
-	homestead bool
+	intrinsic params.IntrinsicGasSchedule // Intrinsic gas prices at the current head
 }
 
 // NewTxPool creates a new transaction pool to gather, sort and filter inbound
@@ -237,6 +237,7 @@ func NewTxPool(config TxPoolConfig, chainconfig *params.ChainConfig, chain block
 		pool.locals.add(addr)
 	}
 	pool.priced = newTxPricedList(pool.all)
+	pool.intrinsic = chainconfig.IntrinsicGasSchedule(chain.CurrentBlock().Number())
 	pool.reset(nil, chain.CurrentBlock().Header())
 
 	// If local transactions and journaling is enabled, load from disk
@@ -288,9 +289,7 @@ func (pool *TxPool) loop() {
 		case ev := <-pool.chainHeadCh:
 			if ev.Block != nil {
 				pool.mu.Lock()
-				if pool.chainconfig.IsHomestead(ev.Block.Number()) {
-					pool.homestead = true
-				}
+				pool.intrinsic = pool.chainconfig.IntrinsicGasSchedule(ev.Block.Number())
 				pool.reset(head.Header(), ev.Block.Header())
 				head = ev.Block
 
@@ -598,7 +597,7 @@ func (pool *TxPool) validateTx(tx *types.Transaction, local bool) error {
 	if pool.currentState.GetBalance(from).Cmp(tx.Cost()) < 0 {
 		return ErrInsufficientFunds
 	}
-	intrGas, err := IntrinsicGas(tx.Data(), tx.To() == nil, pool.homestead)
+	intrGas, err := intrinsicGas(tx.Data(), nil, tx.To() == nil, pool.intrinsic)
 	if err != nil {
 		return err
 	}
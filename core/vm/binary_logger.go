@@ -0,0 +1,173 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/eximchain/go-ethereum/common"
+)
+
+// BinaryTraceVersion is the version of the encoding produced by BinaryLogger.
+const BinaryTraceVersion = 1
+
+var (
+	errBinaryTraceVersion   = errors.New("unsupported binary trace version")
+	errBinaryTraceTruncated = errors.New("truncated binary trace")
+	errBinaryTraceTrailing  = errors.New("trailing data after binary trace")
+)
+
+// BinaryStep is a single execution step of a binary trace.
+type BinaryStep struct {
+	Op    OpCode // Executed opcode
+	Gas   uint64 // Gas available before execution
+	Cost  uint64 // Gas cost of the opcode
+	Depth int    // Call depth of the executing contract
+}
+
+// BinaryTrace is a compact execution trace suitable for long-term storage.
+type BinaryTrace struct {
+	Steps   []BinaryStep
+	GasUsed uint64 // Gas used by the top level call
+	Failed  bool   // Whether the top level call returned an error
+}
+
+// BinaryLogger is an EVM tracer recording a compact trace of the opcodes, gas
+// and call depth of an execution. Unlike StructLogger it captures no memory,
+// stack or storage, trading detail for a size suitable for archival.
+type BinaryLogger struct {
+	trace BinaryTrace
+}
+
+// NewBinaryLogger returns a new binary logger.
+func NewBinaryLogger() *BinaryLogger {
+	return new(BinaryLogger)
+}
+
+// CaptureStart implements the Tracer interface to initialize the tracing operation.
+func (l *BinaryLogger) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	return nil
+}
+
+// CaptureState records the opcode, gas and depth of an execution step.
+func (l *BinaryLogger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, memory *Memory, stack *Stack, contract *Contract, depth int, err error) error {
+	l.trace.Steps = append(l.trace.Steps, BinaryStep{Op: op, Gas: gas, Cost: cost, Depth: depth})
+	return nil
+}
+
+// CaptureFault implements the Tracer interface to trace an execution fault
+// while running an opcode.
+func (l *BinaryLogger) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, memory *Memory, stack *Stack, contract *Contract, depth int, err error) error {
+	return nil
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (l *BinaryLogger) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) error {
+	l.trace.GasUsed = gasUsed
+	l.trace.Failed = err != nil
+	return nil
+}
+
+// Trace returns the captured trace.
+func (l *BinaryLogger) Trace() *BinaryTrace { return &l.trace }
+
+// Encode serializes the trace into its versioned binary form. The layout is a
+// version byte, the varint encoded gas used, a failure flag byte and the varint
+// encoded step count, followed by the opcode and varint encoded depth, gas and
+// cost of each step.
+func (t *BinaryTrace) Encode() []byte {
+	var (
+		buf = make([]byte, 0, 2+2*binary.MaxVarintLen64+len(t.Steps)*8)
+		tmp [binary.MaxVarintLen64]byte
+	)
+	putUvarint := func(x uint64) {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], x)]...)
+	}
+	buf = append(buf, BinaryTraceVersion)
+	putUvarint(t.GasUsed)
+	if t.Failed {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	putUvarint(uint64(len(t.Steps)))
+	for _, step := range t.Steps {
+		buf = append(buf, byte(step.Op))
+		putUvarint(uint64(step.Depth))
+		putUvarint(step.Gas)
+		putUvarint(step.Cost)
+	}
+	return buf
+}
+
+// DecodeBinaryTrace parses a trace previously serialized with Encode.
+func DecodeBinaryTrace(data []byte) (*BinaryTrace, error) {
+	if len(data) == 0 {
+		return nil, errBinaryTraceTruncated
+	}
+	if data[0] != BinaryTraceVersion {
+		return nil, errBinaryTraceVersion
+	}
+	data = data[1:]
+
+	var err error
+	uvarint := func() uint64 {
+		x, n := binary.Uvarint(data)
+		if n <= 0 {
+			err = errBinaryTraceTruncated
+			return 0
+		}
+		data = data[n:]
+		return x
+	}
+	readByte := func() byte {
+		if len(data) == 0 {
+			err = errBinaryTraceTruncated
+			return 0
+		}
+		b := data[0]
+		data = data[1:]
+		return b
+	}
+	trace := &BinaryTrace{GasUsed: uvarint()}
+	trace.Failed = readByte() != 0
+	count := uvarint()
+	if err != nil {
+		return nil, err
+	}
+	// Every step takes at least four bytes, don't trust larger counts
+	if count > uint64(len(data)/4) {
+		return nil, errBinaryTraceTruncated
+	}
+	trace.Steps = make([]BinaryStep, count)
+	for i := range trace.Steps {
+		trace.Steps[i].Op = OpCode(readByte())
+		trace.Steps[i].Depth = int(uvarint())
+		trace.Steps[i].Gas = uvarint()
+		trace.Steps[i].Cost = uvarint()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > 0 {
+		return nil, errBinaryTraceTrailing
+	}
+	return trace, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBinaryTraceRoundtrip(t *testing.T) {
+	logger := NewBinaryLogger()
+	logger.CaptureState(nil, 0, PUSH1, 100000, 3, nil, nil, nil, 1, nil)
+	logger.CaptureState(nil, 2, CALL, 99997, 40, nil, nil, nil, 1, nil)
+	logger.CaptureState(nil, 0, SSTORE, 1<<40, 20000, nil, nil, nil, 2, nil)
+	logger.CaptureEnd(nil, 54321, time.Second, errors.New("failed"))
+
+	blob := logger.Trace().Encode()
+	trace, err := DecodeBinaryTrace(blob)
+	if err != nil {
+		t.Fatalf("failed to decode trace: %v", err)
+	}
+	if !reflect.DeepEqual(trace, logger.Trace()) {
+		t.Fatalf("trace mismatch: have %+v, want %+v", trace, logger.Trace())
+	}
+	// Make sure corrupted traces are rejected
+	if _, err := DecodeBinaryTrace(blob[:len(blob)-1]); err != errBinaryTraceTruncated {
+		t.Errorf("truncated trace error mismatch: have %v, want %v", err, errBinaryTraceTruncated)
+	}
+	if _, err := DecodeBinaryTrace(append(blob, 0)); err != errBinaryTraceTrailing {
+		t.Errorf("trailing data error mismatch: have %v, want %v", err, errBinaryTraceTrailing)
+	}
+	blob[0] = BinaryTraceVersion + 1
+	if _, err := DecodeBinaryTrace(blob); err != errBinaryTraceVersion {
+		t.Errorf("version error mismatch: have %v, want %v", err, errBinaryTraceVersion)
+	}
+}
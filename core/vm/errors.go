@@ -27,4 +27,6 @@ var (
 	ErrInsufficientBalance      = errors.New("insufficient balance for transfer")
 	ErrContractAddressCollision = errors.New("contract address collision")
 	ErrNoCompatibleInterpreter  = errors.New("no compatible interpreter")
+	ErrMaxCodeSizeExceeded      = errors.New("evm: max code size exceeded")
+	ErrExecutionReverted        = errors.New("evm: execution reverted")
 )
@@ -53,6 +53,9 @@ func run(evm *EVM, contract *Contract, input []byte) ([]byte, error) {
 	}
 	for _, interpreter := range evm.interpreters {
 		if interpreter.CanRun(contract.Code) {
+			if evm.depth == 0 {
+				evm.executedInterpreter = interpreter
+			}
 			if evm.interpreter != interpreter {
 				// Ensure that the interpreter pointer is set back
 				// to its current value upon return.
@@ -115,9 +118,13 @@ type EVM struct {
 	// evm.
 	vmConfig Config
 	// global (to this context) ethereum virtual machine
-	// used throughout the execution of the tx.
+	// used throughout the execution of the tx. Custom interpreters
+	// precede the default EVM interpreter, which is always last.
 	interpreters []Interpreter
 	interpreter  Interpreter
+	// executedInterpreter is the interpreter that ran the code of the
+	// top level call or contract creation.
+	executedInterpreter Interpreter
 	// abort is used to abort the EVM calling operations
 	// NOTE: must be set atomically
 	abort int32
@@ -125,6 +132,9 @@ type EVM struct {
 	// available gas is calculated in gasCall* according to the 63/64 rule and later
 	// applied in opCall*.
 	callGasTemp uint64
+	// failedTransfers counts the value transfers of nested calls that failed
+	// due to insufficient balance.
+	failedTransfers uint64
 }
 
 // NewEVM returns a new EVM. The returned EVM is not thread safe and should
@@ -156,6 +166,50 @@ func (evm *EVM) Interpreter() Interpreter {
 	return evm.interpreter
 }
 
+// AddInterpreter registers a custom interpreter, e.g. for an alternative
+// bytecode format. Code is run by the first registered interpreter whose
+// CanRun accepts it, falling back to the default EVM interpreter otherwise.
+func (evm *EVM) AddInterpreter(interpreter Interpreter) {
+	last := len(evm.interpreters) - 1
+	evm.interpreters = append(evm.interpreters[:last:last], interpreter, evm.interpreters[last])
+}
+
+// ExecutedInterpreter returns the interpreter that ran the code of the last top
+// level call or contract creation, or nil if no code was executed.
+func (evm *EVM) ExecutedInterpreter() Interpreter {
+	return evm.executedInterpreter
+}
+
+// FailedTransfers returns the number of value transfers of nested calls and
+// contract creations that failed due to insufficient balance. Such failures
+// don't abort the execution, the calling contract merely observes a failed call.
+func (evm *EVM) FailedTransfers() uint64 {
+	return evm.failedTransfers
+}
+
+// transferFailed records a failed value transfer, unless it is the one of the
+// top level call which is reported to the caller as an error instead.
+func (evm *EVM) transferFailed() {
+	if evm.depth > 0 {
+		evm.failedTransfers++
+	}
+}
+
+// SetBlockContext replaces the block number, timestamp and gas limit of the
+// EVM context and re-derives the chain rules and the default interpreter for
+// the new block number, so that fork dependent behaviour follows the new
+// block. It is meant for simulating messages at hypothetical blocks and must
+// not be used while processing blocks.
+func (evm *EVM) SetBlockContext(number, timestamp *big.Int, gasLimit uint64) {
+	evm.BlockNumber = number
+	evm.Time = timestamp
+	evm.GasLimit = gasLimit
+
+	evm.chainRules = evm.chainConfig.Rules(number)
+	evm.interpreters[len(evm.interpreters)-1] = NewEVMInterpreter(evm, evm.vmConfig)
+	evm.interpreter = evm.interpreters[len(evm.interpreters)-1]
+}
+
 // Call executes the contract associated with the addr with the given input as
 // parameters. It also handles any necessary value transfer required and takes
 // the necessary steps to create accounts and reverses the state in case of an
@@ -164,6 +218,9 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 	if evm.vmConfig.NoRecursion && evm.depth > 0 {
 		return nil, gas, nil
 	}
+	if evm.depth == 0 {
+		evm.executedInterpreter = nil
+	}
 
 	// Fail if we're trying to execute above the call depth limit
 	if evm.depth > int(params.CallCreateDepth) {
@@ -171,6 +228,7 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 	}
 	// Fail if we're trying to transfer more than the available balance
 	if !evm.Context.CanTransfer(evm.StateDB, caller.Address(), value) {
+		evm.transferFailed()
 		return nil, gas, ErrInsufficientBalance
 	}
 
@@ -217,7 +275,7 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 	// when we're in homestead this also counts for code storage gas errors.
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
-		if err != errExecutionReverted {
+		if err != ErrExecutionReverted {
 			contract.UseGas(contract.Gas)
 		}
 	}
@@ -242,6 +300,7 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 	}
 	// Fail if we're trying to transfer more than the available balance
 	if !evm.CanTransfer(evm.StateDB, caller.Address(), value) {
+		evm.transferFailed()
 		return nil, gas, ErrInsufficientBalance
 	}
 
@@ -258,7 +317,7 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 	ret, err = run(evm, contract, input)
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
-		if err != errExecutionReverted {
+		if err != ErrExecutionReverted {
 			contract.UseGas(contract.Gas)
 		}
 	}
@@ -291,7 +350,7 @@ func (evm *EVM) DelegateCall(caller ContractRef, addr common.Address, input []by
 	ret, err = run(evm, contract, input)
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
-		if err != errExecutionReverted {
+		if err != ErrExecutionReverted {
 			contract.UseGas(contract.Gas)
 		}
 	}
@@ -334,7 +393,7 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 	ret, err = run(evm, contract, input)
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
-		if err != errExecutionReverted {
+		if err != ErrExecutionReverted {
 			contract.UseGas(contract.Gas)
 		}
 	}
@@ -343,12 +402,16 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 
 // create creates a new contract using code as deployment code.
 func (evm *EVM) create(caller ContractRef, code []byte, gas uint64, value *big.Int, address common.Address) ([]byte, common.Address, uint64, error) {
+	if evm.depth == 0 {
+		evm.executedInterpreter = nil
+	}
 	// Depth check execution. Fail if we're trying to execute above the
 	// limit.
 	if evm.depth > int(params.CallCreateDepth) {
 		return nil, common.Address{}, gas, ErrDepth
 	}
 	if !evm.CanTransfer(evm.StateDB, caller.Address(), value) {
+		evm.transferFailed()
 		return nil, common.Address{}, gas, ErrInsufficientBalance
 	}
 	nonce := evm.StateDB.GetNonce(caller.Address())
@@ -404,13 +467,13 @@ func (evm *EVM) create(caller ContractRef, code []byte, gas uint64, value *big.I
 	// when we're in homestead this also counts for code storage gas errors.
 	if maxCodeSizeExceeded || (err != nil && (evm.ChainConfig().IsHomestead(evm.BlockNumber) || err != ErrCodeStoreOutOfGas)) {
 		evm.StateDB.RevertToSnapshot(snapshot)
-		if err != errExecutionReverted {
+		if err != ErrExecutionReverted {
 			contract.UseGas(contract.Gas)
 		}
 	}
 	// Assign err if contract code size exceeds the max while the err is still empty.
 	if maxCodeSizeExceeded && err == nil {
-		err = errMaxCodeSizeExceeded
+		err = ErrMaxCodeSizeExceeded
 	}
 	if evm.vmConfig.Debug && evm.depth == 0 {
 		evm.vmConfig.Tracer.CaptureEnd(ret, gas-contract.Gas, time.Since(start), err)
@@ -418,7 +418,8 @@ func gasSuicide(gt params.GasTable, evm *EVM, contract *Contract, stack *Stack,
 		}
 	}
 
-	if !evm.StateDB.HasSuicided(contract.Address()) {
+	// The suicide refund was removed by EIP-3529 in London
+	if !evm.StateDB.HasSuicided(contract.Address()) && !evm.ChainConfig().IsLondon(evm.BlockNumber) {
 		evm.StateDB.AddRefund(params.SuicideRefundGas)
 	}
 	return gas, nil
@@ -18,6 +18,7 @@ package runtime
 
 import (
 	"math/big"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -116,6 +117,41 @@ func TestCall(t *testing.T) {
 	}
 }
 
+// Tests that a stored binary trace decodes to the trace of a re-execution of
+// the same code, so archived traces can be verified by replaying.
+func TestBinaryTraceReplay(t *testing.T) {
+	code := []byte{
+		byte(vm.PUSH1), 10,
+		byte(vm.PUSH1), 0,
+		byte(vm.SSTORE),
+		byte(vm.PUSH1), 32,
+		byte(vm.PUSH1), 0,
+		byte(vm.RETURN),
+	}
+	execute := func() *vm.BinaryTrace {
+		logger := vm.NewBinaryLogger()
+		if _, _, err := Execute(code, nil, &Config{EVMConfig: vm.Config{Debug: true, Tracer: logger}}); err != nil {
+			t.Fatal("didn't expect error", err)
+		}
+		return logger.Trace()
+	}
+	blob := execute().Encode()
+
+	stored, err := vm.DecodeBinaryTrace(blob)
+	if err != nil {
+		t.Fatalf("failed to decode trace: %v", err)
+	}
+	if len(stored.Steps) != 6 {
+		t.Fatalf("step count mismatch: have %d, want 6", len(stored.Steps))
+	}
+	if stored.GasUsed == 0 || stored.Failed {
+		t.Fatalf("unexpected result: gas used %d, failed %v", stored.GasUsed, stored.Failed)
+	}
+	if replayed := execute(); !reflect.DeepEqual(stored, replayed) {
+		t.Fatalf("replay mismatch: have %+v, want %+v", replayed, stored)
+	}
+}
+
 func BenchmarkCall(b *testing.B) {
 	var definition = `[{"constant":true,"inputs":[],"name":"seller","outputs":[{"name":"","type":"address"}],"type":"function"},{"constant":false,"inputs":[],"name":"abort","outputs":[],"type":"function"},{"constant":true,"inputs":[],"name":"value","outputs":[{"name":"","type":"uint256"}],"type":"function"},{"constant":false,"inputs":[],"name":"refund","outputs":[],"type":"function"},{"constant":true,"inputs":[],"name":"buyer","outputs":[{"name":"","type":"address"}],"type":"function"},{"constant":false,"inputs":[],"name":"confirmReceived","outputs":[],"type":"function"},{"constant":true,"inputs":[],"name":"state","outputs":[{"name":"","type":"uint8"}],"type":"function"},{"constant":false,"inputs":[],"name":"confirmPurchase","outputs":[],"type":"function"},{"inputs":[],"type":"constructor"},{"anonymous":false,"inputs":[],"name":"Aborted","type":"event"},{"anonymous":false,"inputs":[],"name":"PurchaseConfirmed","type":"event"},{"anonymous":false,"inputs":[],"name":"ItemReceived","type":"event"},{"anonymous":false,"inputs":[],"name":"Refunded","type":"event"}]`
 
@@ -45,6 +45,9 @@ var (
 		EIP158Block:         big.NewInt(0),
 		ByzantiumBlock:      big.NewInt(0),
 		ConstantinopleBlock: nil,
+		IstanbulBlock:       nil,
+		LondonBlock:         nil,
+		EIP3607Block:        nil,
 		Ethash:              new(EthashConfig),
 	}
 
@@ -60,6 +63,9 @@ var (
 		EIP158Block:         big.NewInt(10),
 		ByzantiumBlock:      big.NewInt(1700000),
 		ConstantinopleBlock: nil,
+		IstanbulBlock:       nil,
+		LondonBlock:         nil,
+		EIP3607Block:        nil,
 		Ethash:              new(EthashConfig),
 	}
 
@@ -75,6 +81,9 @@ var (
 		EIP158Block:         big.NewInt(3),
 		ByzantiumBlock:      big.NewInt(1035301),
 		ConstantinopleBlock: nil,
+		IstanbulBlock:       nil,
+		LondonBlock:         nil,
+		EIP3607Block:        nil,
 		Clique: &CliqueConfig{
 			Period: 15,
 			Epoch:  30000,
@@ -86,16 +95,16 @@ var (
 	//
 	// This configuration is intentionally not using keyed fields to force anyone
 	// adding flags to the config to also have to set these fields.
-	AllEthashProtocolChanges = &ChainConfig{big.NewInt(1337), big.NewInt(0), nil, false, big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, new(EthashConfig), nil}
+	AllEthashProtocolChanges = &ChainConfig{big.NewInt(1337), big.NewInt(0), nil, false, big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, nil, nil, nil, nil, new(EthashConfig), nil}
 
 	// AllCliqueProtocolChanges contains every protocol change (EIPs) introduced
 	// and accepted by the Ethereum core developers into the Clique consensus.
 	//
 	// This configuration is intentionally not using keyed fields to force anyone
 	// adding flags to the config to also have to set these fields.
-	AllCliqueProtocolChanges = &ChainConfig{big.NewInt(1337), big.NewInt(0), nil, false, big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, nil, &CliqueConfig{Period: 0, Epoch: 30000}}
+	AllCliqueProtocolChanges = &ChainConfig{big.NewInt(1337), big.NewInt(0), nil, false, big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, nil, nil, nil, nil, nil, &CliqueConfig{Period: 0, Epoch: 30000}}
 
-	TestChainConfig = &ChainConfig{big.NewInt(1), big.NewInt(0), nil, false, big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, new(EthashConfig), nil}
+	TestChainConfig = &ChainConfig{big.NewInt(1), big.NewInt(0), nil, false, big.NewInt(0), common.Hash{}, big.NewInt(0), big.NewInt(0), big.NewInt(0), nil, nil, nil, nil, nil, new(EthashConfig), nil}
 	TestRules       = TestChainConfig.Rules(new(big.Int))
 )
 
@@ -121,6 +130,14 @@ type ChainConfig struct {
 
 	ByzantiumBlock      *big.Int `json:"byzantiumBlock,omitempty"`      // Byzantium switch block (nil = no fork, 0 = already on byzantium)
 	ConstantinopleBlock *big.Int `json:"constantinopleBlock,omitempty"` // Constantinople switch block (nil = no fork, 0 = already activated)
+	IstanbulBlock       *big.Int `json:"istanbulBlock,omitempty"`       // Istanbul switch block (nil = no fork, 0 = already on istanbul)
+	LondonBlock         *big.Int `json:"londonBlock,omitempty"`         // London switch block (nil = no fork, 0 = already on london)
+
+	EIP3607Block *big.Int `json:"eip3607Block,omitempty"` // EIP3607 HF block, rejecting senders with code (nil = no fork)
+
+	// IntrinsicGas overrides the intrinsic gas prices of transactions, zero
+	// fields keeping the mainnet price of the active phase (nil = mainnet prices)
+	IntrinsicGas *IntrinsicGasSchedule `json:"intrinsicGas,omitempty"`
 
 	// Various consensus engines
 	Ethash *EthashConfig `json:"ethash,omitempty"`
@@ -157,7 +174,7 @@ func (c *ChainConfig) String() string {
 	default:
 		engine = "unknown"
 	}
-	return fmt.Sprintf("{ChainID: %v Homestead: %v DAO: %v DAOSupport: %v EIP150: %v EIP155: %v EIP158: %v Byzantium: %v Constantinople: %v Engine: %v}",
+	return fmt.Sprintf("{ChainID: %v Homestead: %v DAO: %v DAOSupport: %v EIP150: %v EIP155: %v EIP158: %v Byzantium: %v Constantinople: %v Istanbul: %v London: %v EIP3607: %v Engine: %v}",
 		c.ChainID,
 		c.HomesteadBlock,
 		c.DAOForkBlock,
@@ -167,6 +184,9 @@ func (c *ChainConfig) String() string {
 		c.EIP158Block,
 		c.ByzantiumBlock,
 		c.ConstantinopleBlock,
+		c.IstanbulBlock,
+		c.LondonBlock,
+		c.EIP3607Block,
 		engine,
 	)
 }
@@ -206,6 +226,21 @@ func (c *ChainConfig) IsConstantinople(num *big.Int) bool {
 	return isForked(c.ConstantinopleBlock, num)
 }
 
+// IsIstanbul returns whether num is either equal to the Istanbul fork block or greater.
+func (c *ChainConfig) IsIstanbul(num *big.Int) bool {
+	return isForked(c.IstanbulBlock, num)
+}
+
+// IsLondon returns whether num is either equal to the London fork block or greater.
+func (c *ChainConfig) IsLondon(num *big.Int) bool {
+	return isForked(c.LondonBlock, num)
+}
+
+// IsEIP3607 returns whether num is either equal to the EIP3607 fork block or greater.
+func (c *ChainConfig) IsEIP3607(num *big.Int) bool {
+	return isForked(c.EIP3607Block, num)
+}
+
 // GasTable returns the gas table corresponding to the current phase (homestead or homestead reprice).
 //
 // The returned GasTable's fields shouldn't, under any circumstances, be changed.
@@ -225,6 +260,32 @@ func (c *ChainConfig) GasTable(num *big.Int) GasTable {
 	}
 }
 
+// IntrinsicGasSchedule returns the intrinsic gas prices of transactions in the
+// given block, applying the overrides of the chain on top of the mainnet prices.
+// Before homestead contract creations are priced like other transactions, so
+// they follow an overridden TxGas unless their price is overridden too.
+func (c *ChainConfig) IntrinsicGasSchedule(num *big.Int) IntrinsicGasSchedule {
+	schedule := DefaultIntrinsicGasSchedule(c.IsHomestead(num), c.IsIstanbul(num))
+	if o := c.IntrinsicGas; o != nil {
+		if o.TxGas != 0 {
+			schedule.TxGas = o.TxGas
+			if !c.IsHomestead(num) {
+				schedule.TxGasContractCreation = o.TxGas
+			}
+		}
+		if o.TxGasContractCreation != 0 {
+			schedule.TxGasContractCreation = o.TxGasContractCreation
+		}
+		if o.TxDataZeroGas != 0 {
+			schedule.TxDataZeroGas = o.TxDataZeroGas
+		}
+		if o.TxDataNonZeroGas != 0 {
+			schedule.TxDataNonZeroGas = o.TxDataNonZeroGas
+		}
+	}
+	return schedule
+}
+
 // CheckCompatible checks whether scheduled fork transitions have been imported
 // with a mismatching chain configuration.
 func (c *ChainConfig) CheckCompatible(newcfg *ChainConfig, height uint64) *ConfigCompatError {
@@ -271,9 +332,35 @@ func (c *ChainConfig) checkCompatible(newcfg *ChainConfig, head *big.Int) *Confi
 	if isForkIncompatible(c.ConstantinopleBlock, newcfg.ConstantinopleBlock, head) {
 		return newCompatError("Constantinople fork block", c.ConstantinopleBlock, newcfg.ConstantinopleBlock)
 	}
+	if isForkIncompatible(c.IstanbulBlock, newcfg.IstanbulBlock, head) {
+		return newCompatError("Istanbul fork block", c.IstanbulBlock, newcfg.IstanbulBlock)
+	}
+	if isForkIncompatible(c.LondonBlock, newcfg.LondonBlock, head) {
+		return newCompatError("London fork block", c.LondonBlock, newcfg.LondonBlock)
+	}
+	if isForkIncompatible(c.EIP3607Block, newcfg.EIP3607Block, head) {
+		return newCompatError("EIP3607 fork block", c.EIP3607Block, newcfg.EIP3607Block)
+	}
+	// Intrinsic gas overrides apply from genesis on
+	if head.Sign() > 0 && !intrinsicGasEqual(c.IntrinsicGas, newcfg.IntrinsicGas) {
+		return newCompatError("intrinsic gas schedule", new(big.Int), new(big.Int))
+	}
 	return nil
 }
 
+// intrinsicGasEqual returns whether two intrinsic gas overrides are the same,
+// a missing override being equal to one without any prices set.
+func intrinsicGasEqual(x, y *IntrinsicGasSchedule) bool {
+	var a, b IntrinsicGasSchedule
+	if x != nil {
+		a = *x
+	}
+	if y != nil {
+		b = *y
+	}
+	return a == b
+}
+
 // isForkIncompatible returns true if a fork scheduled at s1 cannot be rescheduled to
 // block s2 because head is already past the fork.
 func isForkIncompatible(s1, s2, head *big.Int) bool {
@@ -337,7 +424,7 @@ func (err *ConfigCompatError) Error() string {
 type Rules struct {
 	ChainID                                   *big.Int
 	IsHomestead, IsEIP150, IsEIP155, IsEIP158 bool
-	IsByzantium                               bool
+	IsByzantium, IsIstanbul, IsLondon         bool
 }
 
 // Rules ensures c's ChainID is not nil.
@@ -346,5 +433,5 @@ func (c *ChainConfig) Rules(num *big.Int) Rules {
 	if chainID == nil {
 		chainID = new(big.Int)
 	}
-	return Rules{ChainID: new(big.Int).Set(chainID), IsHomestead: c.IsHomestead(num), IsEIP150: c.IsEIP150(num), IsEIP155: c.IsEIP155(num), IsEIP158: c.IsEIP158(num), IsByzantium: c.IsByzantium(num)}
+	return Rules{ChainID: new(big.Int).Set(chainID), IsHomestead: c.IsHomestead(num), IsEIP150: c.IsEIP150(num), IsEIP155: c.IsEIP155(num), IsEIP158: c.IsEIP158(num), IsByzantium: c.IsByzantium(num), IsIstanbul: c.IsIstanbul(num), IsLondon: c.IsLondon(num)}
 }
@@ -70,6 +70,29 @@ func TestCheckCompatible(t *testing.T) {
 				RewindTo:     9,
 			},
 		},
+		{
+			stored:  &ChainConfig{},
+			new:     &ChainConfig{IntrinsicGas: &IntrinsicGasSchedule{}},
+			head:    3,
+			wantErr: nil,
+		},
+		{
+			stored:  &ChainConfig{IntrinsicGas: &IntrinsicGasSchedule{TxGas: 1000}},
+			new:     &ChainConfig{},
+			head:    0,
+			wantErr: nil,
+		},
+		{
+			stored: &ChainConfig{IntrinsicGas: &IntrinsicGasSchedule{TxGas: 1000}},
+			new:    &ChainConfig{IntrinsicGas: &IntrinsicGasSchedule{TxGas: 2000}},
+			head:   3,
+			wantErr: &ConfigCompatError{
+				What:         "intrinsic gas schedule",
+				StoredConfig: big.NewInt(0),
+				NewConfig:    big.NewInt(0),
+				RewindTo:     0,
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -79,3 +102,27 @@ func TestCheckCompatible(t *testing.T) {
 		}
 	}
 }
+
+func TestIntrinsicGasSchedule(t *testing.T) {
+	mainnet := &ChainConfig{HomesteadBlock: big.NewInt(10), IstanbulBlock: big.NewInt(20)}
+	custom := &ChainConfig{HomesteadBlock: big.NewInt(10), IstanbulBlock: big.NewInt(20), IntrinsicGas: &IntrinsicGasSchedule{TxGas: 1000, TxDataNonZeroGas: 8}}
+	creation := &ChainConfig{HomesteadBlock: big.NewInt(10), IntrinsicGas: &IntrinsicGasSchedule{TxGas: 1000, TxGasContractCreation: 5000}}
+
+	tests := []struct {
+		config *ChainConfig
+		number int64
+		want   IntrinsicGasSchedule
+	}{
+		{mainnet, 0, IntrinsicGasSchedule{TxGas, TxGas, TxDataZeroGas, TxDataNonZeroGas}},
+		{mainnet, 10, IntrinsicGasSchedule{TxGas, TxGasContractCreation, TxDataZeroGas, TxDataNonZeroGas}},
+		{mainnet, 20, IntrinsicGasSchedule{TxGas, TxGasContractCreation, TxDataZeroGas, TxDataNonZeroGasEIP2028}},
+		{custom, 0, IntrinsicGasSchedule{1000, 1000, TxDataZeroGas, 8}},
+		{custom, 20, IntrinsicGasSchedule{1000, TxGasContractCreation, TxDataZeroGas, 8}},
+		{creation, 0, IntrinsicGasSchedule{1000, 5000, TxDataZeroGas, TxDataNonZeroGas}},
+	}
+	for i, tt := range tests {
+		if have := tt.config.IntrinsicGasSchedule(big.NewInt(tt.number)); have != tt.want {
+			t.Errorf("test %d: schedule mismatch: have %+v, want %+v", i, have, tt.want)
+		}
+	}
+}
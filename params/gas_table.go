@@ -91,3 +91,31 @@ var (
 		CreateBySuicide: 25000,
 	}
 )
+
+// IntrinsicGasSchedule organizes the gas prices making up the intrinsic gas of
+// a transaction, charged before any EVM execution.
+type IntrinsicGasSchedule struct {
+	TxGas                 uint64 `json:"txGas,omitempty"`                 // Base price of a transaction
+	TxGasContractCreation uint64 `json:"txGasContractCreation,omitempty"` // Base price of a contract creation
+	TxDataZeroGas         uint64 `json:"txDataZeroGas,omitempty"`         // Price of a zero byte of data
+	TxDataNonZeroGas      uint64 `json:"txDataNonZeroGas,omitempty"`      // Price of a non-zero byte of data
+}
+
+// DefaultIntrinsicGasSchedule returns the mainnet intrinsic gas prices. Contract
+// creations are priced higher from homestead and non-zero data bytes lower from
+// Istanbul (EIP-2028).
+func DefaultIntrinsicGasSchedule(homestead, istanbul bool) IntrinsicGasSchedule {
+	schedule := IntrinsicGasSchedule{
+		TxGas:                 TxGas,
+		TxGasContractCreation: TxGas,
+		TxDataZeroGas:         TxDataZeroGas,
+		TxDataNonZeroGas:      TxDataNonZeroGas,
+	}
+	if homestead {
+		schedule.TxGasContractCreation = TxGasContractCreation
+	}
+	if istanbul {
+		schedule.TxDataNonZeroGas = TxDataNonZeroGasEIP2028
+	}
+	return schedule
+}
@@ -58,8 +58,23 @@ const (
 	MemoryGas        uint64 = 3     // Times the address of the (highest referenced byte in memory + 1). NOTE: referencing happens on read, write and in instructions such as RETURN and CALL.
 	TxDataNonZeroGas uint64 = 68    // Per byte of data attached to a transaction that is not equal to zero. NOTE: Not payable on data of calls between transactions.
 
+	TxDataNonZeroGasEIP2028 uint64 = 16 // Per byte of non zero data attached to a transaction after EIP 2028 (part in Istanbul)
+
+	TxAccessListAddressGas    uint64 = 2400 // Per address specified in EIP 2930 access list
+	TxAccessListStorageKeyGas uint64 = 1900 // Per storage key specified in EIP 2930 access list
+
+	// The Refund Quotient is the cap on how much of the used gas can be refunded. Prior to
+	// EIP-3529, refunds were capped to gasUsed / RefundQuotient
+	RefundQuotient uint64 = 2
+
+	// The Refund Quotient is the cap on how much of the used gas can be refunded. After
+	// EIP-3529: refunds are capped to gasUsed / RefundQuotientEIP3529
+	RefundQuotientEIP3529 uint64 = 5
+
 	MaxCodeSize = 24576 // Maximum bytecode to permit for a contract
 
+	MaxCalldataSize uint64 = 4 * 1024 * 1024 // Suggested maximum data of a message outside consensus, about 16.7M gas even as zero bytes
+
 	// Precompiled contract gas prices
 
 	EcrecoverGas            uint64 = 3000   // Elliptic curve sender recovery gas price